@@ -2,34 +2,21 @@
 package steptest
 
 import (
+	"fmt"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
 )
 
-// addOptions adds Headers, Cookies and Basic Auth from step s to request req.
+// addOptions adds the browser profile, Headers and Cookies from step s to request req.
+// Auth is added by *job.addAuth before addOptions so that any Authorization header can be overridden by the steps headers.
 func (j *job) addOptions(s *step, req *http.Request) {
-	j.setUserAgent(req)
-	j.addBasicAuth(s, req)
+	j.setProfileHeaders(req)
 	j.addHeaders(s, req)
 	j.addCookies(s, req)
 }
 
-// setUserAgent will set the User Agent of the request o Chrome Chrome/64.0.3282.186 on Mac OS X 10.13.3
-func (*job) setUserAgent(req *http.Request) {
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_13_3) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/64.0.3282.186 Safari/537.36")
-}
-
-// addBasicAuth adds either local or global Basic Auth from step s to *http.Request req.
-// If both local and global auth parameters are set the local will take precedence.
-func (j *job) addBasicAuth(s *step, req *http.Request) {
-	switch {
-	case s.auth.Username != "" && s.auth.Password != "":
-		req.SetBasicAuth(s.auth.Username, s.auth.Password)
-
-	case j.globalAuth.Username != "" && j.globalAuth.Password != "":
-		req.SetBasicAuth(j.globalAuth.Username, j.globalAuth.Password)
-	}
-}
-
 // addHeaders sets headers from step s to *http.Request req.
 // If header is already set it will be overwritten with the new value.
 func (*job) addHeaders(s *step, req *http.Request) {
@@ -38,39 +25,71 @@ func (*job) addHeaders(s *step, req *http.Request) {
 	}
 }
 
-// addCookies adds cookies from step s to *http.Request req.
-// If cookie is already set it will be overwritten with the new value.
-func (*job) addCookies(s *step, req *http.Request) {
-	for _, cookie := range s.cookies {
-		req.AddCookie(&cookie)
+// addCookies adds the cookies from the jobs j cookie jar that matches the URL of *http.Request req.
+// Any cookies declared with the cookie statement will be added to the jar before that. The cookies
+// that were sent will be stored in step s.
+func (j *job) addCookies(s *step, req *http.Request) {
+	s.cookies = j.addJarCookies(req)
+}
+
+// addJarCookies adds the cookies from the jobs j cookie jar that matches the URL of *http.Request req.
+// Returns []http.Cookie with the cookies that were added.
+func (j *job) addJarCookies(req *http.Request) []http.Cookie {
+	j.seedCookies(req.URL)
+
+	cookies := []http.Cookie{}
+	for _, cookie := range j.cookieJar().Cookies(req.URL) {
+		req.AddCookie(cookie)
+		cookies = append(cookies, *cookie)
 	}
+	return cookies
 }
 
-// appendResponseCookiesToJob will append/replace the cookies that we received from the response res to job j.
-// So that cookies received will automatically be added to the next step of the job.
-func (j *job) appendResponseCookiesToJob(res *http.Response) {
-	for _, cookie := range res.Cookies() {
-		exists := false
+// seedCookies will add the cookies declared with the cookie statement to the jobs j cookie jar.
+// Cookies with a domain are added per job, and cookies without a domain are added for every host the job
+// makes a request against. Variables in the cookie values are replaced before every request, and the cookie
+// is added to the jar again when its value changed, such as when a variable was set by an earlier step.
+func (j *job) seedCookies(u *url.URL) {
+	if j.seededCookies == nil {
+		j.seededCookies = make(map[string]string)
+	}
+
+	for i := range j.cookies {
+		cookie := j.cookies[i]
+		cookie.Value = j.replaceVariables(cookie.Value)
 
-		// If we already have the cookie no need to add it again. Just update the value.
-		for i := range j.cookies {
-			if exists = j.compareCookie(cookie, &j.cookies[i]); exists {
-				j.cookies[i].Value = cookie.Value
-			}
+		key, target := u.Host, &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}
+		if cookie.Domain != "" {
+			key, target = "."+cookie.Domain, &url.URL{Scheme: u.Scheme, Host: strings.TrimPrefix(cookie.Domain, "."), Path: "/"}
 		}
 
-		if !exists {
-			j.cookies = append(j.cookies, *cookie)
+		key = fmt.Sprintf("%s %s %s", key, cookie.Path, cookie.Name)
+		if v, ok := j.seededCookies[key]; ok && v == cookie.Value {
+			continue
 		}
+		j.seededCookies[key] = cookie.Value
+
+		j.cookieJar().SetCookies(target, []*http.Cookie{&cookie})
+	}
+}
+
+// storeResponseCookies will store the cookies that we received from the response res in the jobs j cookie jar.
+// So that cookies received will automatically be added to the next steps of the job where they match.
+// Responses without a request, which custom fetch functions might return, have no URL to store the cookies for.
+func (j *job) storeResponseCookies(res *http.Response) {
+	if res.Request == nil || res.Request.URL == nil {
+		return
 	}
+	j.cookieJar().SetCookies(res.Request.URL, res.Cookies())
 }
 
-// compareCookie will check if name, domain, path are the same for *http.Cookie c1 and c2.
-// If they are the same the returned value will be true.
-// Returns bool.
-func (*job) compareCookie(c1 *http.Cookie, c2 *http.Cookie) bool {
-	if c1.Name == c2.Name && c1.Domain == c2.Domain && c1.Path == c2.Path {
-		return true
+// cookieJar will return the cookie jar of the job j, creating it if it doesn't exist. Every job has it's
+// own jar, just like every browser has, which handles domain and path matching as well as expiry of cookies.
+// Returns *cookiejar.Jar.
+func (j *job) cookieJar() *cookiejar.Jar {
+	if j.jar == nil {
+		// New never returns an error.
+		j.jar, _ = cookiejar.New(nil)
 	}
-	return false
+	return j.jar
 }
@@ -0,0 +1,106 @@
+package steptest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCookieJar(t *testing.T) {
+	j := &job{vars: map[string]string{"currency": "SEK"}}
+
+	cookies := []string{
+		`{ "name": "currency", "value": "{{currency}}" }`,
+		`{ "name": "consent", "value": "yes", "domain": "example.com" }`,
+	}
+	for _, raw := range cookies {
+		if err := createCookie(j, &step{}, &raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shop, _ := url.Parse("https://shop.example.com/checkout")
+	j.storeResponseCookies(&http.Response{
+		Request: &http.Request{URL: shop},
+		Header: http.Header{"Set-Cookie": []string{
+			"session=shop1; Path=/; Secure",
+			"cart=c1; Path=/checkout",
+		}},
+	})
+
+	// The shop should get its own cookies, the declared cookie and the domain cookie.
+	s := &step{}
+	req, _ := http.NewRequest("GET", "https://shop.example.com/checkout/payment", nil)
+	j.addCookies(s, req)
+	if sent := cookieNames(s.cookies); sent != "cart,consent,currency,session," {
+		t.Errorf("Expected cookies %s to be sent to shop but got %s", "cart,consent,currency,session,", sent)
+	}
+
+	if c, _ := req.Cookie("currency"); c == nil || c.Value != "SEK" {
+		t.Errorf("Expected declared cookie currency to have variables replaced")
+	}
+
+	// The payment domain should only get the domain cookie and the declared cookie.
+	req, _ = http.NewRequest("GET", "https://pay.example.com/", nil)
+	j.addCookies(s, req)
+	if sent := cookieNames(s.cookies); sent != "consent,currency," {
+		t.Errorf("Expected cookies %s to be sent to payment but got %s", "consent,currency,", sent)
+	}
+
+	// Secure cookies should not be sent over http and a Max-Age=0 should delete the cookie.
+	j.storeResponseCookies(&http.Response{
+		Request: &http.Request{URL: shop},
+		Header:  http.Header{"Set-Cookie": []string{"cart=; Path=/checkout; Max-Age=0"}},
+	})
+
+	req, _ = http.NewRequest("GET", "http://shop.example.com/checkout", nil)
+	j.addCookies(s, req)
+	if sent := cookieNames(s.cookies); sent != "consent,currency," {
+		t.Errorf("Expected cookies %s to be sent to shop over http but got %s", "consent,currency,", sent)
+	}
+}
+
+func TestCookieFromVariable(t *testing.T) {
+	var sent []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("t"); err == nil {
+			sent = append(sent, c.Value)
+		}
+		w.Write([]byte("token=abc123;"))
+	}))
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+
+	// The cookie is sent before token is set, and is seeded again with the value set by varfrom.
+	steps := "- cookie { \"name\": \"t\", \"value\": \"{{token}}\" }\n"
+	steps += "- get " + ts.URL + "\n"
+	steps += "  varfrom { \"from\": \"body\", \"name\": \"token\", \"find\": \"token={{StepTestSyntax}};\" }\n"
+	steps += "- get " + ts.URL + "\n"
+
+	j, err := srv.parseJob(&rawJob{steps: steps})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	if len(sent) != 2 || sent[0] != "{{token}}" || sent[1] != "abc123" {
+		t.Errorf("Expected the cookie t to be sent as {{token}} and then abc123 but got %v", sent)
+	}
+}
+
+// cookieNames returns the sorted names of the cookies c separated by commas.
+func cookieNames(c []http.Cookie) string {
+	names := []string{}
+	for _, cookie := range c {
+		names = append(names, cookie.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",") + ","
+}
@@ -0,0 +1,467 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tokenExpiryMargin = 10 * time.Second // tokenExpiryMargin is how long before it expires an OAuth2 token will be refreshed.
+)
+
+var (
+	// Allowed types for the auth and @auth statements.
+	allowedAuthTypes = []string{"basic", "bearer", "oauth2", "digest"}
+
+	// Allowed caches for OAuth2 tokens.
+	allowedTokenCaches = []string{"server", "worker"}
+)
+
+// parse will validate the auth a and set its type to basic if no type was supplied.
+// Returns error.
+func (a *auth) parse() error {
+	a.Type = strings.ToLower(a.Type)
+	if a.Type == "" {
+		a.Type = "basic"
+	}
+
+	switch a.Type {
+	case "basic", "digest":
+		switch {
+		case a.Username == "":
+			return fmt.Errorf("USERNAME was not supplied")
+
+		case a.Password == "":
+			return fmt.Errorf("PASSWORD was not supplied")
+		}
+
+	case "bearer":
+		if a.Token == "" {
+			return fmt.Errorf("TOKEN was not supplied")
+		}
+
+	case "oauth2":
+		switch {
+		case a.TokenURL == "":
+			return fmt.Errorf("TOKENURL was not supplied")
+
+		case a.ClientID == "":
+			return fmt.Errorf("CLIENTID was not supplied")
+
+		case a.ClientSecret == "":
+			return fmt.Errorf("CLIENTSECRET was not supplied")
+		}
+
+		a.Cache = strings.ToLower(a.Cache)
+		if a.Cache == "" {
+			a.Cache = "server"
+		}
+
+		supported := false
+		for _, c := range allowedTokenCaches {
+			if a.Cache == c {
+				supported = true
+			}
+		}
+
+		if !supported {
+			return fmt.Errorf("CACHE %s is not supported. Supported caches are %s", a.Cache, allowedTokenCaches)
+		}
+
+	default:
+		return fmt.Errorf("TYPE %s is not supported. Supported types are %s", a.Type, allowedAuthTypes)
+	}
+
+	return nil
+}
+
+// authFor will return the auth to use for step s with any variables replaced. The steps auth takes precedence over the jobs j global auth.
+// Returns auth.
+func (j *job) authFor(s *step) auth {
+	a := j.globalAuth
+	if s.auth.Type != "" {
+		a = s.auth
+	}
+
+	a.Username = j.replaceVariables(a.Username)
+	a.Password = j.replaceVariables(a.Password)
+	a.Token = j.replaceVariables(a.Token)
+	a.TokenURL = j.replaceVariables(a.TokenURL)
+	a.ClientID = j.replaceVariables(a.ClientID)
+	a.ClientSecret = j.replaceVariables(a.ClientSecret)
+	a.Scope = j.replaceVariables(a.Scope)
+	return a
+}
+
+// addAuth adds either local or global auth from step s to *http.Request req.
+// If both local and global auth are set the local will take precedence.
+// OAuth2 tokens are fetched with the fetch function c when there is no valid token in the cache.
+// Digest auth is only added if the job has received a challenge from the host before, otherwise it's
+// added by *job.retryAuth when the server responds with a challenge.
+// Returns error.
+func (j *job) addAuth(c func(*http.Request) (*http.Response, error), s *step, req *http.Request) error {
+	a := j.authFor(s)
+
+	switch a.Type {
+	case "basic":
+		req.SetBasicAuth(a.Username, a.Password)
+
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+
+	case "oauth2":
+		token, err := j.tokenCache(&a).get(&a, func() (*oauth2Token, error) { return j.fetchToken(c, s, &a) })
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+	case "digest":
+		if j.digest != nil && j.digest.host == req.URL.Host {
+			req.Header.Set("Authorization", j.digest.authorization(&a, req))
+		}
+	}
+
+	return nil
+}
+
+// retryAuth is called when the request req for step s was answered with 401 Unauthorized in response res.
+// OAuth2 tokens that were rejected are removed from the cache and a new token is fetched, and digest auth
+// will answer the challenge of the response.
+// Returns a new *http.Request to send, or nil if the request shouldn't be retried, and error.
+func (j *job) retryAuth(c func(*http.Request) (*http.Response, error), s *step, req *http.Request, res *http.Response) (*http.Request, error) {
+	a := j.authFor(s)
+
+	switch a.Type {
+	case "oauth2":
+		cache := j.tokenCache(&a)
+		cache.invalidate(&a, strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+
+		token, err := cache.get(&a, func() (*oauth2Token, error) { return j.fetchToken(c, s, &a) })
+		if err != nil {
+			return nil, err
+		}
+
+		retry, err := cloneRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		retry.Header.Set("Authorization", "Bearer "+token)
+		return retry, nil
+
+	case "digest":
+		challenge := parseDigestChallenge(res.Header.Get("WWW-Authenticate"))
+		if challenge == nil {
+			return nil, nil
+		}
+
+		// Only retry a request that was already answering a challenge if the nonce was stale.
+		if req.Header.Get("Authorization") != "" && !strings.EqualFold(challenge.params["stale"], "true") {
+			return nil, nil
+		}
+
+		challenge.host = req.URL.Host
+		j.digest = challenge
+
+		retry, err := cloneRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		retry.Header.Set("Authorization", challenge.authorization(&a, retry))
+		return retry, nil
+	}
+
+	return nil, nil
+}
+
+// cloneRequest will clone the request req with a new copy of its body so that it can be sent again.
+// Returns *http.Request and error.
+func cloneRequest(req *http.Request) (*http.Request, error) {
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't copy the body of the request. %s", err.Error())
+		}
+		retry.Body = body
+	}
+	return retry, nil
+}
+
+// tokenCache contains cached OAuth2 tokens by token URL, client credentials and scope,
+// and the tokens that are being fetched.
+type tokenCache struct {
+	mu       sync.Mutex
+	tokens   map[string]*oauth2Token
+	fetching map[string]*tokenFetch
+}
+
+// tokenFetch is a token being fetched. done is closed when token and err has been set.
+type tokenFetch struct {
+	done  chan struct{}
+	token *oauth2Token
+	err   error
+}
+
+// oauth2Token contains a cached OAuth2 access token and when it expires.
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+
+	expires time.Time
+}
+
+// newTokenCache will create a new empty tokenCache.
+// Returns *tokenCache.
+func newTokenCache() *tokenCache {
+	return &tokenCache{tokens: make(map[string]*oauth2Token), fetching: make(map[string]*tokenFetch)}
+}
+
+// tokenCache will return the token cache to use for the OAuth2 auth a. The server cache is shared by all jobs
+// and the worker cache is shared by all jobs of the same virtual user.
+// Returns *tokenCache.
+func (j *job) tokenCache(a *auth) *tokenCache {
+	if a.Cache == "server" && j.srv != nil {
+		return j.srv.tokens
+	}
+
+	if j.workerTokens == nil {
+		j.workerTokens = newTokenCache()
+	}
+	return j.workerTokens
+}
+
+// get will return a valid token for the OAuth2 auth a from the cache, or fetch a new one with the function fetch.
+// Only one token is fetched at a time per key, callers asking for the same key wait for that fetch
+// while other keys can be used and fetched without waiting.
+// Returns string and error.
+func (tc *tokenCache) get(a *auth, fetch func() (*oauth2Token, error)) (string, error) {
+	key := a.tokenKey()
+
+	tc.mu.Lock()
+	if t, ok := tc.tokens[key]; ok && (t.expires.IsZero() || time.Now().Before(t.expires)) {
+		tc.mu.Unlock()
+		return t.AccessToken, nil
+	}
+
+	if f, ok := tc.fetching[key]; ok {
+		tc.mu.Unlock()
+		<-f.done
+		if f.err != nil {
+			return "", f.err
+		}
+		return f.token.AccessToken, nil
+	}
+
+	f := &tokenFetch{done: make(chan struct{})}
+	tc.fetching[key] = f
+	tc.mu.Unlock()
+
+	f.token, f.err = fetch()
+
+	tc.mu.Lock()
+	delete(tc.fetching, key)
+	if f.err == nil {
+		tc.tokens[key] = f.token
+	}
+	tc.mu.Unlock()
+	close(f.done)
+
+	if f.err != nil {
+		return "", f.err
+	}
+	return f.token.AccessToken, nil
+}
+
+// invalidate will remove the token from the cache if it's still the cached token for the OAuth2 auth a.
+func (tc *tokenCache) invalidate(a *auth, token string) {
+	key := a.tokenKey()
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if t, ok := tc.tokens[key]; ok && t.AccessToken == token {
+		delete(tc.tokens, key)
+	}
+}
+
+// tokenKey returns the key of the OAuth2 auth a in a tokenCache.
+// Returns string.
+func (a *auth) tokenKey() string {
+	return a.TokenURL + "\n" + a.ClientID + "\n" + a.ClientSecret + "\n" + a.Scope
+}
+
+// fetchToken will fetch a new token for the OAuth2 auth a from its token URL with the fetch function c
+// using the client credentials grant. The client credentials are sent with basic auth. The request is sent
+// with the request context of step s, so that the TLS options, proxy and DNS overrides of the job apply.
+// Returns *oauth2Token and error.
+func (j *job) fetchToken(c func(*http.Request) (*http.Response, error), s *step, a *auth) (*oauth2Token, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if a.Scope != "" {
+		form.Set("scope", a.Scope)
+	}
+
+	req, err := http.NewRequest("POST", a.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create token request in *job.fetchToken. %s", err.Error())
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+	req, _ = j.withRequestContext(s, req)
+
+	res, err := c(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't fetch token from %s in *job.fetchToken. %s", a.TokenURL, err.Error())
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read token response from %s in *job.fetchToken. %s", a.TokenURL, err.Error())
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Couldn't fetch token from %s in *job.fetchToken. %d %s", a.TokenURL, res.StatusCode, bodyExcerpt(body))
+	}
+
+	t := new(oauth2Token)
+	err = json.Unmarshal(body, t)
+	if err != nil || t.AccessToken == "" {
+		return nil, fmt.Errorf("Couldn't find access_token in token response from %s in *job.fetchToken. %s", a.TokenURL, bodyExcerpt(body))
+	}
+
+	if t.ExpiresIn > 0 {
+		t.expires = time.Now().Add(time.Duration(t.ExpiresIn)*time.Second - tokenExpiryMargin)
+	}
+
+	return t, nil
+}
+
+// digestChallenge contains a digest auth challenge from a WWW-Authenticate header and the host it was received from.
+type digestChallenge struct {
+	host   string
+	params map[string]string
+	nc     int
+}
+
+// parseDigestChallenge will parse the digest challenge in the WWW-Authenticate header value h.
+// Returns *digestChallenge or nil if h isn't a digest challenge.
+func parseDigestChallenge(h string) *digestChallenge {
+	h = strings.Trim(h, trim)
+	if len(h) < 7 || !strings.EqualFold(h[:7], "digest ") {
+		return nil
+	}
+
+	params := make(map[string]string)
+	rest := h[7:]
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+
+		key := strings.ToLower(strings.Trim(rest[:eq], trim))
+		rest = rest[eq+1:]
+
+		value := ""
+		switch {
+		case strings.HasPrefix(rest, `"`):
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				return nil
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+
+		default:
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = strings.Trim(rest[:end], trim), rest[end:]
+		}
+
+		params[key] = value
+	}
+
+	if params["nonce"] == "" {
+		return nil
+	}
+
+	return &digestChallenge{params: params}
+}
+
+// authorization will return the Authorization header value answering the digest challenge d for the request req
+// with the username and password of the auth a. Every call will increase the nonce count.
+// Returns string.
+func (d *digestChallenge) authorization(a *auth, req *http.Request) string {
+	d.nc++
+	nc := fmt.Sprintf("%08x", d.nc)
+
+	b := make([]byte, 8)
+	io.ReadFull(rand.Reader, b)
+	cnonce := hex.EncodeToString(b)
+
+	uri := req.URL.RequestURI()
+	response, qop := d.response(a.Username, a.Password, req.Method, uri, nc, cnonce)
+
+	h := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`, a.Username, d.params["realm"], d.params["nonce"], uri, response)
+	if algorithm := d.params["algorithm"]; algorithm != "" {
+		h += ", algorithm=" + algorithm
+	}
+	if opaque := d.params["opaque"]; opaque != "" {
+		h += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	if qop != "" {
+		h += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, qop, nc, cnonce)
+	}
+
+	return h
+}
+
+// response will calculate the digest response of the challenge d as described in RFC 7616.
+// Only the qop auth is supported, if the challenge doesn't offer it the legacy RFC 2069 response is calculated.
+// Returns the response and the qop used.
+func (d *digestChallenge) response(username string, password string, method string, uri string, nc string, cnonce string) (string, string) {
+	algorithm := strings.ToUpper(d.params["algorithm"])
+
+	var h func() hash.Hash = md5.New
+	if strings.HasPrefix(algorithm, "SHA-256") {
+		h = sha256.New
+	}
+
+	digest := func(s string) string {
+		hh := h()
+		hh.Write([]byte(s))
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+
+	ha1 := digest(username + ":" + d.params["realm"] + ":" + password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = digest(ha1 + ":" + d.params["nonce"] + ":" + cnonce)
+	}
+	ha2 := digest(method + ":" + uri)
+
+	for _, qop := range strings.Split(d.params["qop"], ",") {
+		if strings.Trim(qop, trim) == "auth" {
+			return digest(strings.Join([]string{ha1, d.params["nonce"], nc, cnonce, "auth", ha2}, ":")), "auth"
+		}
+	}
+
+	return digest(ha1 + ":" + d.params["nonce"] + ":" + ha2), ""
+}
@@ -0,0 +1,264 @@
+package steptest
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBearerAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer abc123" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+
+	steps := "- var { \"name\": \"token\", \"value\": \"abc123\" }\n"
+	steps += "- @auth { \"type\": \"bearer\", \"token\": \"{{token}}\" }\n"
+	steps += "- get " + ts.URL + "\n"
+
+	j, err := srv.parseJob(&rawJob{steps: steps})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+		t.Errorf("Expected bearer token to be accepted but got %s", r.Err.Error)
+	}
+}
+
+// oauth2Server is a token endpoint at /token issuing numbered tokens for client credentials client and secret
+// with scope read, and an API at /api accepting the last issued token. Setting revoked rejects the next API request.
+type oauth2Server struct {
+	*testServer
+	issued  int32
+	revoked int32
+}
+
+// newOAuth2Server will start an oauth2Server.
+func newOAuth2Server(t *testing.T) *oauth2Server {
+	ts := &oauth2Server{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "client" || secret != "secret" || r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "read" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		n := atomic.AddInt32(&ts.issued, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token" + strconv.Itoa(int(n)), "token_type": "bearer", "expires_in": 3600})
+	})
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		valid := "Bearer token" + strconv.Itoa(int(atomic.LoadInt32(&ts.issued)))
+		if r.Header.Get("Authorization") != valid || atomic.LoadInt32(&ts.revoked) == 1 {
+			atomic.StoreInt32(&ts.revoked, 0)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("token expired"))
+		}
+	})
+	ts.testServer = newTestServer(t, mux.ServeHTTP)
+	return ts
+}
+
+// oauth2Steps will return steps getting /api of ts with OAuth2 client credentials client and secret.
+func oauth2Steps(ts *oauth2Server, secret string) string {
+	steps := "- @auth { \"type\": \"oauth2\", \"tokenUrl\": \"" + ts.URL + "/token\", \"clientId\": \"client\", \"clientSecret\": \"" + secret + "\", \"scope\": \"read\" }\n"
+	return steps + "- get " + ts.URL + "/api\n"
+}
+
+func TestOAuth2Auth(t *testing.T) {
+	ts := newOAuth2Server(t)
+
+	srv, _ := New(1, 5000, nil)
+
+	// The token should be cached on the Server and shared between the jobs.
+	for i := 0; i < 2; i++ {
+		j, err := srv.parseJob(&rawJob{steps: oauth2Steps(ts, "secret")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+			t.Fatal(r.Err.Error)
+		}
+	}
+
+	if n := atomic.LoadInt32(&ts.issued); n != 1 {
+		t.Errorf("Expected 1 token to be issued but got %d", n)
+	}
+}
+
+func TestOAuth2Refresh(t *testing.T) {
+	ts := newOAuth2Server(t)
+
+	srv, _ := New(1, 5000, nil)
+
+	// A rejected token should be refreshed and the request retried.
+	atomic.StoreInt32(&ts.revoked, 1)
+	j, _ := srv.parseJob(&rawJob{steps: oauth2Steps(ts, "secret")})
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err != nil {
+		t.Fatalf("Expected the token to be refreshed on 401 but got %s", r.Err.Error)
+	}
+
+	// The body of the 401 is counted as received.
+	if n := r.Steps[1].BytesReceived; n != int64(len("token expired")) {
+		t.Errorf("Expected %d bytes received but got %d", len("token expired"), n)
+	}
+
+	if n := atomic.LoadInt32(&ts.issued); n != 2 {
+		t.Errorf("Expected 2 tokens to be issued after refresh but got %d", n)
+	}
+
+	// Invalid client credentials should fail the step.
+	j, _ = srv.parseJob(&rawJob{steps: oauth2Steps(ts, "wrong")})
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err == nil {
+		t.Errorf("Expected error for invalid client credentials but got nil")
+	}
+}
+
+func TestOAuth2Resolve(t *testing.T) {
+	ts := newOAuth2Server(t)
+
+	srv, _ := New(1, 5000, nil)
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	// The token request uses the DNS overrides of the job.
+	steps := "- @resolve auth.example.com:" + port + "=127.0.0.1:" + port + "\n"
+	steps += "- @auth { \"type\": \"oauth2\", \"tokenUrl\": \"http://auth.example.com:" + port + "/token\", \"clientId\": \"client\", \"clientSecret\": \"secret\", \"scope\": \"read\" }\n"
+	steps += "- get " + ts.URL + "/api\n"
+
+	j, err := srv.parseJob(&rawJob{steps: steps})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+		t.Fatalf("Expected the token to be fetched from the resolved token URL but got %s", r.Err.Error)
+	}
+
+	if received := ts.requests(); received[0].Host != "auth.example.com:"+port {
+		t.Errorf("Expected the token request to be sent to auth.example.com:%s but got %s", port, received[0].Host)
+	}
+}
+
+func TestOAuth2Concurrent(t *testing.T) {
+	ts := newOAuth2Server(t)
+
+	srv, _ := New(1, 5000, nil)
+
+	// Variables are replaced in the token URL and client credentials, and concurrent jobs wait for the same token.
+	vars := map[string]string{"tokenUrl": ts.URL + "/token", "client": "client", "secret": "secret"}
+	steps := "- @auth { \"type\": \"oauth2\", \"tokenUrl\": \"{{tokenUrl}}\", \"clientId\": \"{{client}}\", \"clientSecret\": \"{{secret}}\", \"scope\": \"read\" }\n"
+	steps += "- get " + ts.URL + "/api\n"
+
+	var wg sync.WaitGroup
+	errs := make(chan *ResultError, 5)
+	for i := 0; i < 5; i++ {
+		j, err := srv.parseJob(&rawJob{steps: steps, vars: vars})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- srv.fetchJob(j, srv.fetchFunc).Err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Expected the token to be fetched with the variables but got %s", err.Error)
+		}
+	}
+
+	if n := atomic.LoadInt32(&ts.issued); n != 1 {
+		t.Errorf("Expected 1 token to be issued for the concurrent jobs but got %d", n)
+	}
+}
+
+func TestCreateAuth(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+
+	for _, a := range []string{
+		"{ \"type\": \"oauth2\", \"clientId\": \"client\", \"clientSecret\": \"secret\" }",
+		"{ \"type\": \"oauth2\", \"tokenUrl\": \"http://x\", \"clientId\": \"client\", \"clientSecret\": \"secret\", \"cache\": \"job\" }",
+		"{ \"type\": \"bearer\" }",
+		"{ \"type\": \"ntlm\", \"username\": \"user\", \"password\": \"pass\" }",
+	} {
+		if _, err := srv.parseJob(&rawJob{steps: "- @auth " + a + "\n"}); err == nil {
+			t.Errorf("Expected error for invalid auth %s but got nil", a)
+		}
+	}
+}
+
+func TestDigestAuth(t *testing.T) {
+	var challenges int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		d := parseDigestChallenge(header)
+		if d != nil {
+			expected, _ := (&digestChallenge{params: map[string]string{"realm": "test", "nonce": "n0nce", "qop": "auth"}}).response("user", "pass", r.Method, d.params["uri"], d.params["nc"], d.params["cnonce"])
+			if d.params["response"] == expected && d.params["username"] == "user" && d.params["opaque"] == "op" {
+				return
+			}
+		}
+
+		atomic.AddInt32(&challenges, 1)
+		w.Header().Set("WWW-Authenticate", `Digest realm="test", nonce="n0nce", qop="auth,auth-int", opaque="op", algorithm=MD5`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+
+	steps := "- @auth { \"type\": \"digest\", \"username\": \"user\", \"password\": \"pass\" }\n"
+	steps += "- post " + ts.URL + "/a?b=c {\"name\":\"value\"}\n"
+	steps += "- get " + ts.URL + "/d\n"
+
+	j, err := srv.parseJob(&rawJob{steps: steps})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	// The challenge should be reused for the second request.
+	if n := atomic.LoadInt32(&challenges); n != 1 {
+		t.Errorf("Expected 1 digest challenge but got %d", n)
+	}
+
+	// Wrong password should fail without retrying forever.
+	j, _ = srv.parseJob(&rawJob{steps: strings.Replace(steps, "\"pass\"", "\"wrong\"", 1)})
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err == nil || r.Err.Status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for wrong digest password but got %v", r.Err)
+	}
+}
+
+func TestDigestResponse(t *testing.T) {
+	// Example from RFC 2617 section 3.5.
+	d := parseDigestChallenge(`Digest realm="testrealm@host.com", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`)
+	if d == nil {
+		t.Fatal("Expected digest challenge to be parsed but got nil")
+	}
+
+	response, qop := d.response("Mufasa", "Circle Of Life", "GET", "/dir/index.html", "00000001", "0a4f113b")
+	if response != "6629fae49393a05397450978507c4ef1" || qop != "auth" {
+		t.Errorf("Expected response 6629fae49393a05397450978507c4ef1 with qop auth but got %s with qop %s", response, qop)
+	}
+}
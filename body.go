@@ -0,0 +1,229 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	defaultRepeatPattern = "a" // defaultRepeatPattern is the pattern repeated by @repeat bodies if no pattern was supplied.
+)
+
+var (
+	// Supported size units of generated bodies.
+	bodySizeUnits = map[string]int64{
+		"":   1,
+		"B":  1,
+		"KB": 1024,
+		"MB": 1024 * 1024,
+		"GB": 1024 * 1024 * 1024,
+	}
+)
+
+// bodySource contains where a streamed body is read from. A file is read from path, a random body is size
+// random bytes and a repeated body is pattern repeated until it's size bytes.
+type bodySource struct {
+	kind    string
+	path    string
+	size    int64
+	pattern []byte
+}
+
+// parseBodySource will parse the body b if it starts with @file:, @random: or @repeat:.
+// Returns *bodySource, or nil if b is a regular body, and error.
+func parseBodySource(b string) (*bodySource, error) {
+	b = strings.Trim(b, trim)
+
+	switch {
+	case strings.HasPrefix(b, "@file:"):
+		path := strings.TrimPrefix(b, "@file:")
+		if path == "" {
+			return nil, fmt.Errorf("@file body needs a path")
+		}
+		return &bodySource{kind: "file", path: path}, nil
+
+	case strings.HasPrefix(b, "@random:"):
+		size, err := parseBodySize(strings.TrimPrefix(b, "@random:"))
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse @random body. %s", err.Error())
+		}
+		return &bodySource{kind: "random", size: size}, nil
+
+	case strings.HasPrefix(b, "@repeat:"):
+		v := strings.SplitN(strings.TrimPrefix(b, "@repeat:"), ":", 2)
+		size, err := parseBodySize(v[0])
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse @repeat body. %s", err.Error())
+		}
+
+		pattern := defaultRepeatPattern
+		if len(v) > 1 && v[1] != "" {
+			pattern = v[1]
+		}
+		return &bodySource{kind: "repeat", size: size, pattern: []byte(pattern)}, nil
+	}
+
+	return nil, nil
+}
+
+// parseBodySize will parse the size s, which is a number of bytes with an optional B, KB, MB or GB unit.
+// Returns int64 and error.
+func parseBodySize(s string) (int64, error) {
+	s = strings.ToUpper(strings.Trim(s, trim))
+	number := strings.TrimRight(s, "BKMG")
+
+	unit, ok := bodySizeUnits[s[len(number):]]
+	if !ok {
+		return 0, fmt.Errorf("Size %s has an unsupported unit. Supported units are B, KB, MB and GB", s)
+	}
+
+	size, err := strconv.ParseInt(strings.Trim(number, trim), 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("Size %s is not a positive number of bytes", s)
+	}
+
+	return size * unit, nil
+}
+
+// requestBody is the body of a request, which is either held in memory or streamed from a file or a generator.
+// Every reader opened by open starts from the beginning of the body, so that the request can be sent again
+// and signed without buffering the body. Length is -1 if it isn't known before the body is sent.
+type requestBody struct {
+	open   func() (io.ReadCloser, error)
+	length int64
+
+	// The number of bytes read by the transport, for every time the body was sent.
+	sent int64
+}
+
+// requestBody will create the body of the request for step s, compressed with compression c.
+// Streamed bodies compressed with gzip are compressed while they are sent, so their length isn't known.
+// Returns *requestBody and error.
+func (j *job) requestBody(s *step, c string) (*requestBody, error) {
+	src, err := parseBodySource(s.body)
+	if err != nil {
+		return nil, err
+	}
+
+	if src == nil {
+		body, err := compressBody([]byte(s.body), c)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't compress the Body. %s", err.Error())
+		}
+
+		return &requestBody{
+			open:   func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(body)), nil },
+			length: int64(len(body)),
+		}, nil
+	}
+
+	b := &requestBody{length: src.size}
+	switch src.kind {
+	case "file":
+		info, err := os.Stat(src.path)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't open @file body. %s", err.Error())
+		}
+
+		b.length = info.Size()
+		b.open = func() (io.ReadCloser, error) { return os.Open(src.path) }
+
+	case "random":
+		// The seed is kept so that the same bytes are generated every time the body is opened.
+		seed := rand.Int63()
+		b.open = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(io.LimitReader(rand.New(rand.NewSource(seed)), src.size)), nil
+		}
+
+	case "repeat":
+		b.open = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(io.LimitReader(&repeatReader{pattern: src.pattern}, src.size)), nil
+		}
+	}
+
+	if c == "gzip" {
+		open := b.open
+		b.open = func() (io.ReadCloser, error) { return gzipStream(open) }
+		b.length = -1
+	}
+
+	return b, nil
+}
+
+// reader will open the body b for the transport, counting the bytes read from it in b.sent.
+// Returns io.ReadCloser and error.
+func (b *requestBody) reader() (io.ReadCloser, error) {
+	r, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+	return &sentBody{ReadCloser: r, sent: &b.sent}, nil
+}
+
+// bytesSent returns the number of bytes of the body b that has been sent.
+// Returns int64.
+func (b *requestBody) bytesSent() int64 {
+	return atomic.LoadInt64(&b.sent)
+}
+
+// sentBody is a request body that counts the bytes read from it by the transport.
+type sentBody struct {
+	io.ReadCloser
+	sent *int64
+}
+
+// Read will read from the body and count the bytes read.
+// Returns int and error.
+func (s *sentBody) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	atomic.AddInt64(s.sent, int64(n))
+	return n, err
+}
+
+// repeatReader is an endless reader repeating pattern.
+type repeatReader struct {
+	pattern []byte
+	offset  int
+}
+
+// Read will fill p with the pattern, continuing where the last read stopped.
+// Returns int and error.
+func (r *repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.pattern[r.offset]
+		r.offset = (r.offset + 1) % len(r.pattern)
+	}
+	return len(p), nil
+}
+
+// gzipStream will open the body with open and compress it with gzip while it's read.
+// Returns io.ReadCloser and error.
+func gzipStream(open func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	src, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer src.Close()
+
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, src)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
@@ -0,0 +1,116 @@
+package steptest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// uploadRequest is the Content-Length, decompressed body and X-Signature header of a request to the upload server.
+type uploadRequest struct {
+	length    int64
+	body      []byte
+	signature string
+}
+
+// newUploadServer will start a server that stores the last request it received in last.
+func newUploadServer(last *uploadRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, _ := gzip.NewReader(bytes.NewReader(body))
+			body, _ = ioutil.ReadAll(gz)
+		}
+		*last = uploadRequest{length: r.ContentLength, body: body, signature: r.Header.Get("X-Signature")}
+	}))
+}
+
+func TestStreamedBody(t *testing.T) {
+	var last uploadRequest
+	ts := newUploadServer(&last)
+	defer ts.Close()
+
+	file := filepath.Join(t.TempDir(), "upload.bin")
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	if err := os.WriteFile(file, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, _ := New(1, 5000, nil)
+
+	for _, test := range []struct {
+		name   string
+		steps  string
+		length int64
+		body   []byte
+	}{
+		{"file", "- var { \"name\": \"file\", \"value\": \"" + file + "\" }\n- post " + ts.URL + "/file @file:{{file}}\n", int64(len(content)), content},
+		{"repeat", "- put " + ts.URL + "/repeat @repeat:10KB:ab\n", 10240, []byte(strings.Repeat("ab", 5120))},
+		// Compressed streams are sent without a Content-Length.
+		{"gzip", "- post " + ts.URL + "/gzip @repeat:1KB\n  compress gzip\n", -1, []byte(strings.Repeat("a", 1024))},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			j, err := srv.parseJob(&rawJob{steps: test.steps})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := srv.fetchJob(j, srv.fetchFunc)
+			if r.Err != nil {
+				t.Fatal(r.Err.Error)
+			}
+
+			if last.length != test.length || !bytes.Equal(last.body, test.body) {
+				t.Errorf("Expected %d bytes with Content-Length %d but got %d bytes and %d", len(test.body), test.length, len(last.body), last.length)
+			}
+
+			if sent := r.Steps[len(r.Steps)-1].BytesSent; test.length != -1 && sent != test.length {
+				t.Errorf("Expected %d bytes sent but got %d", test.length, sent)
+			}
+		})
+	}
+}
+
+func TestStreamedBodySigned(t *testing.T) {
+	var last uploadRequest
+	ts := newUploadServer(&last)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+
+	j, err := srv.parseJob(&rawJob{steps: "- post " + ts.URL + "/random @random:1MB\n  sign { \"type\": \"hmac\", \"secret\": \"s3cret\" }\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	// The random body is generated again when it's sent, so the signature should match the received body.
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("POST\n/random\n"))
+	mac.Write(last.body)
+	if expected := hex.EncodeToString(mac.Sum(nil)); last.length != 1<<20 || last.signature != expected {
+		t.Errorf("Expected 1MB random body with signature %s but got %d bytes and %s", expected, last.length, last.signature)
+	}
+}
+
+func TestCreateStreamedBody(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+
+	for _, a := range []string{"@random:10XB", "@repeat:abc", "@file:", "@random:-1"} {
+		if _, err := srv.parseJob(&rawJob{steps: "- post http://example.com " + a + "\n"}); err == nil {
+			t.Errorf("Expected error for invalid body %s but got nil", a)
+		}
+	}
+}
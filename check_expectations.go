@@ -0,0 +1,262 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusRange contains a inclusive range of status codes.
+type statusRange struct {
+	from int
+	to   int
+}
+
+// checkExpectations will check all the expect statements of step s against the response res, the body raw and
+// the response time d. Every expectation that failed will be listed in the returned error. Schema expectations
+// will list every violation of the schema.
+// Returns *ResultError.
+func (j *job) checkExpectations(s *step, res *http.Response, raw *[]byte, d time.Duration) *ResultError {
+	failed := []string{}
+
+	for _, e := range s.expect {
+		if e.Type == "schema" {
+			failed = append(failed, e.schema.validate(*raw)...)
+			continue
+		}
+
+		if msg := j.checkExpectation(&e, res, raw, d); msg != "" {
+			failed = append(failed, msg)
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	return &ResultError{
+		Error:        fmt.Errorf("%d %s %s failed expectations: %s", res.StatusCode, s.method, s.url, strings.Join(failed, ", ")),
+		URL:          s.url,
+		Status:       res.StatusCode,
+		Body:         bodyExcerpt(*raw),
+		Expectations: failed,
+	}
+}
+
+// checkExpectation will check a single expectation e against the response res, the body raw and the response time d.
+// Returns a description of the failed expectation or an empty string if it was met.
+func (*job) checkExpectation(e *expectation, res *http.Response, raw *[]byte, d time.Duration) string {
+	switch e.Type {
+	case "status":
+		if !matchStatus(e.statuses, res.StatusCode) {
+			return fmt.Sprintf("status %d not in %s", res.StatusCode, e.Value)
+		}
+
+	case "contains":
+		if !bytes.Contains(*raw, []byte(e.Value)) {
+			return fmt.Sprintf("body doesn't contain %q", e.Value)
+		}
+
+	case "notcontains":
+		if bytes.Contains(*raw, []byte(e.Value)) {
+			return fmt.Sprintf("body contains %q", e.Value)
+		}
+
+	case "regexp":
+		if !e.regexp.Match(*raw) {
+			return fmt.Sprintf("body doesn't match %s", e.Value)
+		}
+
+	case "json":
+		doc, err := decodeJSON(*raw)
+		if err != nil {
+			return fmt.Sprintf("body isn't valid JSON (%s)", err.Error())
+		}
+
+		value, ok := jsonPathLookup(doc, e.Path)
+		switch {
+		case !ok:
+			return fmt.Sprintf("json path %s doesn't exist", e.Path)
+
+		case e.Value != "" && jsonValueString(value) != e.Value:
+			return fmt.Sprintf("json path %s is %s, expected %s", e.Path, jsonValueString(value), e.Value)
+		}
+
+	case "header":
+		values, ok := res.Header[http.CanonicalHeaderKey(e.Name)]
+		switch {
+		case !ok:
+			return fmt.Sprintf("header %s is missing", e.Name)
+
+		case e.Value != "" && values[0] != e.Value:
+			return fmt.Sprintf("header %s is %q, expected %q", e.Name, values[0], e.Value)
+		}
+
+	case "time":
+		if d > e.maxTime {
+			return fmt.Sprintf("response time %d ms exceeds %s ms", d/time.Millisecond, e.Value)
+		}
+	}
+
+	return ""
+}
+
+// expectsStatus returns true if the step s has any status expectation. If it has
+// the regular status code check should be ignored in favor of the expectation.
+// Returns bool.
+func (s *step) expectsStatus() bool {
+	for _, e := range s.expect {
+		if e.Type == "status" {
+			return true
+		}
+	}
+	return false
+}
+
+// needsBody returns true if step s needs the response body for varfrom or expect statements,
+// to check graphql steps for errors or for AfterResponse hooks.
+// Returns bool.
+func (s *step) needsBody() bool {
+	if len(s.varfrom) > 0 || s.graphql != nil || len(s.afterResponse) > 0 {
+		return true
+	}
+
+	for _, e := range s.expect {
+		switch e.Type {
+		case "contains", "notcontains", "regexp", "json", "schema":
+			return true
+		}
+	}
+	return false
+}
+
+// needsJSON returns true if step s needs the whole response body to decode it as JSON for json or schema
+// expectations, JSON varfrom statements or to check graphql steps for errors.
+// Returns bool.
+func (s *step) needsJSON() bool {
+	if s.graphql != nil {
+		return true
+	}
+
+	for _, v := range s.varfrom {
+		if strings.ToUpper(v.From) == "JSON" {
+			return true
+		}
+	}
+
+	for _, e := range s.expect {
+		switch e.Type {
+		case "json", "schema":
+			return true
+		}
+	}
+	return false
+}
+
+// parseStatusRanges will parse status codes from string v. Status codes are separated by commas and can be
+// either a single code (200), a range (200-299) or a class (2xx).
+// Returns []statusRange and error.
+func parseStatusRanges(v string) ([]statusRange, error) {
+	ranges := []statusRange{}
+
+	for _, part := range strings.Split(v, ",") {
+		part = strings.Trim(part, trim)
+		bounds := strings.SplitN(part, "-", 2)
+
+		switch {
+		case len(part) == 3 && strings.HasSuffix(strings.ToLower(part), "xx"):
+			class, err := strconv.Atoi(part[:1])
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't parse status class %s in parseStatusRanges", part)
+			}
+			ranges = append(ranges, statusRange{class * 100, class*100 + 99})
+
+		case len(bounds) == 2:
+			from, err := strconv.Atoi(strings.Trim(bounds[0], trim))
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't parse status range %s in parseStatusRanges", part)
+			}
+			to, err := strconv.Atoi(strings.Trim(bounds[1], trim))
+			if err != nil || to < from {
+				return nil, fmt.Errorf("Couldn't parse status range %s in parseStatusRanges", part)
+			}
+			ranges = append(ranges, statusRange{from, to})
+
+		default:
+			code, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't parse status code %s in parseStatusRanges", part)
+			}
+			ranges = append(ranges, statusRange{code, code})
+		}
+	}
+
+	return ranges, nil
+}
+
+// matchStatus returns true if status code c is within any of the ranges r.
+// Returns bool.
+func matchStatus(r []statusRange, c int) bool {
+	for _, sr := range r {
+		if c >= sr.from && c <= sr.to {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonPathLookup will look up the value at path p in the decoded JSON document doc.
+// Path segments are separated by dots and array indexes can be written as either items.0 or items[0].
+// An empty path or $ returns the whole document.
+// Returns interface{} and true if the path exists.
+func jsonPathLookup(doc interface{}, p string) (interface{}, bool) {
+	p = strings.TrimPrefix(strings.TrimPrefix(p, "$"), ".")
+	p = strings.Replace(strings.Replace(p, "[", ".", -1), "]", "", -1)
+	if p == "" {
+		return doc, true
+	}
+
+	current := doc
+	for _, key := range strings.Split(p, ".") {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			value, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			current = value
+
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			current = v[i]
+
+		default:
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+// jsonValueString will convert the decoded JSON value v to a string. Strings are returned as is,
+// everything else is returned as compact JSON.
+// Returns string.
+func jsonValueString(v interface{}) string {
+	if str, ok := v.(string); ok {
+		return str
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
@@ -0,0 +1,79 @@
+package steptest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckExpectations(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"cart":{"id":"c1","items":[{"sku":"p1","qty":2}]}}`))
+	}))
+	defer ts.Close()
+
+	j := &job{vars: map[string]string{"sku": "p1"}}
+	s := &step{method: "DELETE", url: ts.URL}
+
+	for _, raw := range []string{
+		`{ "type": "status", "value": "200,404" }`,
+		`{ "type": "contains", "value": "{{sku}}" }`,
+		`{ "type": "json", "path": "cart.items[0].qty", "value": "2" }`,
+		`{ "type": "header", "name": "content-type", "value": "application/json" }`,
+		`{ "type": "time", "value": "10000" }`,
+	} {
+		if err := createExpect(j, s, &raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status, resErr := j.fetchStep(http.DefaultClient.Do, s)
+	if resErr != nil {
+		t.Fatal(resErr.Error)
+	}
+
+	if status != 404 {
+		t.Errorf("Expected status to be %d but got %d", 404, status)
+	}
+
+	s = &step{method: "GET", url: ts.URL}
+	for _, raw := range []string{
+		`{ "type": "status", "value": "2xx" }`,
+		`{ "type": "notcontains", "value": "cart" }`,
+		`{ "type": "regexp", "value": "\"id\":\"c[0-9]\"" }`,
+		`{ "type": "json", "path": "cart.total" }`,
+		`{ "type": "header", "name": "X-Cache" }`,
+	} {
+		if err := createExpect(j, s, &raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, resErr = j.fetchStep(http.DefaultClient.Do, s)
+	if resErr == nil {
+		t.Fatal("Expected failed expectations to result in an error but got nil")
+	}
+
+	if len(resErr.Expectations) != 4 {
+		t.Errorf("Expected %d failed expectations but got %d. %v", 4, len(resErr.Expectations), resErr.Expectations)
+	}
+}
+
+func TestParseStatusRanges(t *testing.T) {
+	ranges, err := parseStatusRanges("200, 301-302, 4xx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for code, expected := range map[int]bool{200: true, 201: false, 302: true, 303: false, 404: true, 500: false} {
+		if matchStatus(ranges, code) != expected {
+			t.Errorf("Expected matchStatus for %d to be %t but got %t", code, expected, !expected)
+		}
+	}
+
+	if _, err := parseStatusRanges("2x"); err == nil {
+		t.Errorf("Expected error for invalid status but got nil")
+	}
+}
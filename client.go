@@ -0,0 +1,237 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxRedirects = 10 // defaultMaxRedirects is the max number of redirects to follow in the follow mode, same as net/http.
+)
+
+var (
+	// Allowed modes for the redirect statement.
+	allowedRedirectModes = []string{"follow", "none", "max"}
+)
+
+// requestContextKey is the key used to store the *requestContext in the context of a request.
+type requestContextKey struct{}
+
+// requestContext contains the job and step that a request is made for. It's stored in the context of
+// the request so that the built-in client can apply job and step specific settings and record data
+// about the request on the step.
+type requestContext struct {
+	job  *job
+	step *step
+
+	// Time of the start of the current hop, used to time redirects.
+	hopStart time.Time
+}
+
+// redirectPolicy contains how redirects should be handled.
+type redirectPolicy struct {
+	Mode string `json:"mode"`
+	Max  int    `json:"max"`
+}
+
+// parse will validate the redirect policy r.
+// Returns error.
+func (r *redirectPolicy) parse() error {
+	for _, m := range allowedRedirectModes {
+		if r.Mode == m {
+			if r.Mode == "max" && r.Max < 1 {
+				return fmt.Errorf("Redirect mode max needs a max of at least 1")
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Redirect mode %s is not supported. Supported modes are %s", r.Mode, allowedRedirectModes)
+}
+
+// withRequestContext will return a copy of request req with a *requestContext for job j and step s.
+// Returns *http.Request and *requestContext.
+func (j *job) withRequestContext(s *step, req *http.Request) (*http.Request, *requestContext) {
+	rc := &requestContext{job: j, step: s, hopStart: time.Now()}
+	return req.WithContext(context.WithValue(req.Context(), requestContextKey{}, rc)), rc
+}
+
+// getRequestContext will return the *requestContext of request req, or nil if it has none.
+// Returns *requestContext.
+func getRequestContext(req *http.Request) *requestContext {
+	rc, _ := req.Context().Value(requestContextKey{}).(*requestContext)
+	return rc
+}
+
+// redirectPolicy will return the redirect policy to use for step s. The steps policy takes precedence over the Servers.
+// Returns redirectPolicy.
+func (j *job) redirectPolicy(s *step) redirectPolicy {
+	switch {
+	case s.redirectPolicy.Mode != "":
+		return s.redirectPolicy
+
+	case j.srv != nil && j.srv.redirectPolicy.Mode != "":
+		return j.srv.redirectPolicy
+	}
+
+	return redirectPolicy{Mode: "follow"}
+}
+
+// clientSet contains the built-in clients for a connection scope, which is either the whole Server,
+// a worker or a job depending on the connection model. There is one client per TLS config and protocol,
+// and the clients are created on first use.
+type clientSet struct {
+	srv *Server
+
+	mu      sync.Mutex
+	clients map[clientKey]*http.Client
+}
+
+// clientKey contains the settings that needs a client of their own. Shaped clients are also separated by the
+// bandwidth of the virtual user, so that the connections of a virtual user share its bandwidth.
+type clientKey struct {
+	tls       *tls.Config
+	protocol  string
+	proxy     string
+	resolve   string
+	network   networkShape
+	bandwidth *bandwidth
+}
+
+// protocol will return the protocol to use for step s. The steps protocol takes precedence over the Servers.
+// Returns string.
+func (j *job) protocol(s *step) string {
+	switch {
+	case s.protocol != "":
+		return s.protocol
+
+	case j.srv != nil:
+		return j.srv.protocol
+	}
+
+	return ""
+}
+
+// newClientSet will create a new clientSet for the Server.
+// Returns *clientSet.
+func (srv *Server) newClientSet() *clientSet {
+	return &clientSet{srv: srv, clients: make(map[clientKey]*http.Client)}
+}
+
+// newClient will create a new *http.Client with a new transport using the settings of key k
+// for the built-in fetch function.
+// Returns *http.Client.
+func (srv *Server) newClient(k clientKey) *http.Client {
+	return &http.Client{
+		Transport:     srv.newTransport(k),
+		Timeout:       srv.timeout,
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// fetch is the built-in fetch function used when no custom fetch function was passed to New.
+// The client to use is selected by the TLS config, proxy, DNS overrides and network shape of the job and the protocol of the step the request req is made for.
+// Returns *http.Response and error.
+func (cs *clientSet) fetch(req *http.Request) (*http.Response, error) {
+	k := clientKey{tls: cs.srv.tlsConfig, protocol: cs.srv.protocol, proxy: cs.srv.proxy, resolve: resolveKey(cs.srv.resolve), network: cs.srv.network}
+	if rc := getRequestContext(req); rc != nil {
+		k = clientKey{tls: rc.job.tlsConfig(), protocol: rc.job.protocol(rc.step), proxy: rc.job.proxy(), resolve: rc.job.resolveKey(), network: rc.job.network(), bandwidth: rc.job.bandwidth()}
+	}
+
+	cs.mu.Lock()
+	client, ok := cs.clients[k]
+	if !ok {
+		client = cs.srv.newClient(k)
+		cs.clients[k] = client
+	}
+	cs.mu.Unlock()
+
+	return client.Do(req)
+}
+
+// closeIdleConnections will close any idle connections of the clients in the clientSet cs.
+// Should be called when the scope of the clientSet has ended.
+func (cs *clientSet) closeIdleConnections() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for _, client := range cs.clients {
+		client.CloseIdleConnections()
+	}
+}
+
+// fetchFuncForWorker will return the fetch function a worker should use based on the connection model.
+// Returns func(*http.Request) (*http.Response, error) and a function to call when the worker is done.
+func (srv *Server) fetchFuncForWorker() (func(*http.Request) (*http.Response, error), func()) {
+	if srv.customFetch || srv.connectionModel != "worker" {
+		return srv.fetchFunc, func() {}
+	}
+
+	cs := srv.newClientSet()
+	return cs.fetch, cs.closeIdleConnections
+}
+
+// fetchFuncForJob will return the fetch function a job should use based on the connection model.
+// Worker fetch function c will be used unless every job should have its own connections.
+// Returns func(*http.Request) (*http.Response, error) and a function to call when the job is done.
+func (srv *Server) fetchFuncForJob(c func(*http.Request) (*http.Response, error)) (func(*http.Request) (*http.Response, error), func()) {
+	if srv.customFetch || srv.connectionModel != "job" {
+		return c, func() {}
+	}
+
+	cs := srv.newClientSet()
+	return cs.fetch, cs.closeIdleConnections
+}
+
+// checkRedirect is the CheckRedirect function of the built-in client. It will record every followed redirect
+// on the step of the request req and stop following redirects based on the redirect policy of the step.
+// Cookies are handled by the jobs cookie jar for every followed redirect.
+// Returns error.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	rc := getRequestContext(req)
+	if rc == nil {
+		if len(via) >= defaultMaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", defaultMaxRedirects)
+		}
+		return nil
+	}
+
+	policy := rc.job.redirectPolicy(rc.step)
+	if policy.Mode == "none" {
+		return http.ErrUseLastResponse
+	}
+
+	// via contains every request made so far. The follow mode stops at the same number of requests
+	// as net/http, and the max mode after following max redirects.
+	max, limit := defaultMaxRedirects, defaultMaxRedirects
+	if policy.Mode == "max" {
+		max, limit = policy.Max, policy.Max+1
+	}
+
+	if len(via) >= limit {
+		return fmt.Errorf("stopped after %d redirects", max)
+	}
+
+	// Store the cookies of the redirect response and send the ones matching the new URL,
+	// just like a browser would.
+	rc.job.storeResponseCookies(req.Response)
+	req.Header.Del("Cookie")
+	rc.job.addJarCookies(req)
+
+	now := time.Now()
+	rc.step.redirects = append(rc.step.redirects, ResultRedirect{
+		StartTime: rc.hopStart,
+		Duration:  now.Sub(rc.hopStart),
+		Status:    req.Response.StatusCode,
+		URL:       via[len(via)-1].URL.String(),
+		Location:  req.URL.String(),
+	})
+	rc.hopStart = now
+
+	return nil
+}
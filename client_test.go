@@ -0,0 +1,91 @@
+package steptest
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// redirectHops redirects with 302 until the hops in the query reach 0.
+func redirectHops(w http.ResponseWriter, r *http.Request) {
+	hops, _ := strconv.Atoi(r.URL.Query().Get("hops"))
+	if hops > 0 {
+		http.Redirect(w, r, "/?hops="+strconv.Itoa(hops-1), http.StatusFound)
+		return
+	}
+	w.Write([]byte("done"))
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	ts := newTestServer(t, redirectHops)
+
+	srv, err := New(1, 5000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		steps     string
+		fail      bool
+		status    int
+		redirects int
+	}{
+		{"follow", "- get " + ts.URL + "/?hops=3\n", false, 200, 3},
+		{"none", "- get " + ts.URL + "/?hops=3\n  redirect { \"mode\": \"none\" }\n  expect { \"type\": \"status\", \"value\": \"302\" }\n", false, 302, 0},
+		// A refused redirect isn't recorded as followed.
+		{"max", "- get " + ts.URL + "/?hops=3\n  redirect { \"mode\": \"max\", \"max\": 2 }\n", true, -1, 2},
+		// follow stops after 10 requests, just like net/http.
+		{"follow limit", "- get " + ts.URL + "/?hops=12\n", true, -1, defaultMaxRedirects - 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			j, err := srv.parseJob(&rawJob{steps: test.steps})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := srv.fetchJob(j, srv.fetchFunc)
+			if (r.Err != nil) != test.fail {
+				t.Fatalf("Expected failure to be %t but got %v", test.fail, r.Err)
+			}
+
+			step := r.Steps[0]
+			if len(step.Redirects) != test.redirects {
+				t.Fatalf("Expected %d redirects but got %d", test.redirects, len(step.Redirects))
+			}
+
+			if !test.fail && step.Status != test.status {
+				t.Errorf("Expected status %d but got %d", test.status, step.Status)
+			}
+		})
+	}
+}
+
+func TestRedirectsRecorded(t *testing.T) {
+	ts := newTestServer(t, redirectHops)
+
+	srv, _ := New(1, 5000, nil)
+
+	j, err := srv.parseJob(&rawJob{steps: "- get " + ts.URL + "/?hops=3\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	follow := r.Steps[0]
+	if follow.Redirects[0].Status != 302 || follow.Redirects[0].Location != ts.URL+"/?hops=2" {
+		t.Errorf("Expected first redirect to be %d to %s but got %d to %s", 302, ts.URL+"/?hops=2", follow.Redirects[0].Status, follow.Redirects[0].Location)
+	}
+
+	if follow.FinalURL != ts.URL+"/?hops=0" {
+		t.Errorf("Expected final URL to be %s but got %s", ts.URL+"/?hops=0", follow.FinalURL)
+	}
+
+	if received := ts.requests(); len(received) != 4 || received[3].URL.String() != "/?hops=0" {
+		t.Errorf("Expected %d requests ending with /?hops=0 but got %d", 4, len(received))
+	}
+}
@@ -0,0 +1,157 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	defaultAcceptEncoding = "gzip, deflate, br" // defaultAcceptEncoding is the Accept-Encoding header sent when no profile or header sets it.
+)
+
+var (
+	// Allowed compressions for the compress and @compress statements.
+	allowedCompressions = []string{"none", "gzip"}
+)
+
+// countingBody is a response body that counts the bytes read from it.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+// Read will read from the body and count the bytes read.
+// Returns int and error.
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// decodedBody is a decoded response body that closes both the decoder and the original body.
+type decodedBody struct {
+	io.Reader
+	decoder io.Closer
+	body    io.Closer
+}
+
+// Close will close the decoder and the original body.
+// Returns error.
+func (d *decodedBody) Close() error {
+	d.decoder.Close()
+	return d.body.Close()
+}
+
+// decodeBody will decode the body of the response res if it's encoded with gzip, deflate or br and wasn't
+// already decoded by the fetch function. The Content-Encoding header of the response is kept as received.
+// Returns error.
+func decodeBody(res *http.Response) error {
+	if res.Uncompressed {
+		return nil
+	}
+
+	var decoder io.ReadCloser
+	var err error
+
+	switch strings.ToLower(strings.Trim(res.Header.Get("Content-Encoding"), trim)) {
+	case "gzip", "x-gzip":
+		decoder, err = gzip.NewReader(res.Body)
+
+	case "deflate":
+		decoder, err = deflateReader(res.Body)
+
+	case "br":
+		decoder = io.NopCloser(brotli.NewReader(res.Body))
+
+	default:
+		return nil
+	}
+
+	// Empty bodies, such as for HEAD requests, has nothing to decode.
+	if err == io.EOF {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Couldn't decode %s body. %s", res.Header.Get("Content-Encoding"), err.Error())
+	}
+
+	res.Body = &decodedBody{Reader: decoder, decoder: decoder, body: res.Body}
+	res.ContentLength = -1
+	res.Uncompressed = true
+
+	return nil
+}
+
+// deflateReader will return a reader decoding the deflate body r. Deflate should be zlib wrapped, but since some
+// servers send raw deflate data it's used when the body doesn't start with a zlib header.
+// Returns io.ReadCloser and error.
+func deflateReader(r io.Reader) (io.ReadCloser, error) {
+	b := bufio.NewReader(r)
+	header, err := b.Peek(2)
+	if len(header) == 0 {
+		return nil, err
+	}
+
+	// A zlib header uses the deflate method and is a multiple of 31.
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(b)
+	}
+	return flate.NewReader(b), nil
+}
+
+// compression will return the compression to use for the request body of step s. The steps compression takes precedence over the jobs j.
+// Steps without a body aren't compressed, since even an empty gzip stream would send a body.
+// Returns string.
+func (j *job) compression(s *step) string {
+	switch {
+	case s.body == "":
+		return ""
+
+	case s.compression != "":
+		return s.compression
+	}
+	return j.globalCompression
+}
+
+// parseCompression will validate the compression c.
+// Returns string and error.
+func parseCompression(c string) (string, error) {
+	c = strings.ToLower(strings.Trim(c, trim))
+	for _, compression := range allowedCompressions {
+		if c == compression {
+			return c, nil
+		}
+	}
+
+	return "", fmt.Errorf("Compression %s is not supported. Supported compressions are %s", c, allowedCompressions)
+}
+
+// compressBody will compress the body b with compression c.
+// Returns []byte and error.
+func compressBody(b []byte, c string) ([]byte, error) {
+	if c != "gzip" {
+		return b, nil
+	}
+
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write(b); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,238 @@
+package steptest
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// cachedPage is the page served by the page server.
+var cachedPage = strings.Repeat("<div class=\"product\">Magento full page cache</div>", 200)
+
+// newPageServer will start a server that responds with cachedPage encoded by the encoding in the query.
+// Gzipped request bodies are decoded and the last one is stored in requestBody.
+func newPageServer(requestBody *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			b, _ := ioutil.ReadAll(gz)
+			*requestBody = string(b)
+		}
+
+		var enc io.WriteCloser
+		switch r.URL.Query().Get("encoding") {
+		case "gzip":
+			enc = gzip.NewWriter(w)
+
+		case "deflate":
+			enc = zlib.NewWriter(w)
+
+		case "br":
+			enc = brotli.NewWriter(w)
+
+		default:
+			w.Write([]byte(cachedPage))
+			return
+		}
+
+		w.Header().Set("Content-Encoding", r.URL.Query().Get("encoding"))
+		enc.Write([]byte(cachedPage))
+		enc.Close()
+	}))
+}
+
+func TestCompression(t *testing.T) {
+	var requestBody string
+	ts := newPageServer(&requestBody)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+
+	for _, encoding := range []string{"gzip", "deflate", "br", "identity"} {
+		t.Run(encoding, func(t *testing.T) {
+			steps := "- get " + ts.URL + "/?encoding=" + encoding + "\n"
+			steps += "  expect { \"type\": \"contains\", \"value\": \"Magento full page cache</div>\" }\n"
+
+			j, err := srv.parseJob(&rawJob{steps: steps})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := srv.fetchJob(j, srv.fetchFunc)
+			if r.Err != nil {
+				t.Fatal(r.Err.Error)
+			}
+
+			step := r.Steps[0]
+			if encoding == "identity" {
+				encoding = ""
+			}
+
+			if step.ContentEncoding != encoding {
+				t.Errorf("Expected content encoding %q but got %q", encoding, step.ContentEncoding)
+			}
+
+			if step.BytesDecoded != int64(len(cachedPage)) {
+				t.Errorf("Expected %d decoded bytes but got %d", len(cachedPage), step.BytesDecoded)
+			}
+
+			switch {
+			case encoding == "" && step.BytesReceived != step.BytesDecoded:
+				t.Errorf("Expected received and decoded bytes to be equal without encoding but got %d and %d", step.BytesReceived, step.BytesDecoded)
+
+			case encoding != "" && step.BytesReceived >= step.BytesDecoded/10:
+				t.Errorf("Expected %q to be compressed on the wire but got %d received bytes", encoding, step.BytesReceived)
+			}
+		})
+	}
+}
+
+func TestCompressRequest(t *testing.T) {
+	var requestBody string
+	ts := newPageServer(&requestBody)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+	body := "{\"cart\":\"" + strings.Repeat("item", 100) + "\"}"
+
+	j, err := srv.parseJob(&rawJob{steps: "- post " + ts.URL + "/ " + body + "\n  compress gzip\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	if requestBody != body {
+		t.Errorf("Expected the gzipped request body to be decoded by the server but got %s", requestBody)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(body))
+	gz.Close()
+	if sent := r.Steps[0].BytesSent; sent != int64(buf.Len()) {
+		t.Errorf("Expected %d bytes sent but got %d", buf.Len(), sent)
+	}
+}
+
+func TestCompressBodyless(t *testing.T) {
+	var encoding string
+	var length int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding, length = r.Header.Get("Content-Encoding"), r.ContentLength
+	}))
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+
+	// An empty gzip stream isn't empty, so requests without a body aren't compressed.
+	j, err := srv.parseJob(&rawJob{steps: "- @compress gzip\n- get " + ts.URL + "\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	if encoding != "" || length != 0 || r.Steps[1].BytesSent != 0 {
+		t.Errorf("Expected a GET without body or Content-Encoding but got %q, Content-Length %d and %d bytes sent", encoding, length, r.Steps[1].BytesSent)
+	}
+}
+
+func TestTransferTotals(t *testing.T) {
+	var requestBody string
+	ts := newPageServer(&requestBody)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+
+	steps := "- get " + ts.URL + "/?encoding=gzip\n"
+	steps += "- get " + ts.URL + "/\n"
+	steps += "- post " + ts.URL + "/ {\"cart\":\"c1\"}\n"
+	steps += "  compress gzip\n"
+
+	j, err := srv.parseJob(&rawJob{steps: steps})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	received := int64(0)
+	for _, step := range r.Steps {
+		received += step.BytesReceived
+	}
+
+	srv.results = []*Result{r}
+	if total := srv.GetTotalBytesReceived(); total != received {
+		t.Errorf("Expected %d total bytes received but got %d", received, total)
+	}
+
+	// Every step, including the post, responds with the page.
+	if decoded := srv.GetTotalBytesDecoded(); decoded != int64(3*len(cachedPage)) {
+		t.Errorf("Expected %d total bytes decoded but got %d", 3*len(cachedPage), decoded)
+	}
+
+	if sent := srv.GetTotalBytesSent(); sent != r.Steps[2].BytesSent || sent == 0 {
+		t.Errorf("Expected %d total bytes sent but got %d", r.Steps[2].BytesSent, sent)
+	}
+}
+
+func TestCreateCompression(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+
+	if _, err := srv.parseJob(&rawJob{steps: "- get http://example.com\n  compress zstd\n"}); err == nil {
+		t.Errorf("Expected error for unsupported compression but got nil")
+	}
+}
+
+func TestDecodeRawDeflate(t *testing.T) {
+
+	for _, zlibHeader := range []bool{true, false} {
+		var buf bytes.Buffer
+		var enc io.WriteCloser
+		if zlibHeader {
+			enc = zlib.NewWriter(&buf)
+		} else {
+			enc, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+		}
+		enc.Write([]byte(cachedPage))
+		enc.Close()
+
+		res := &http.Response{Header: http.Header{"Content-Encoding": {"deflate"}}, Body: ioutil.NopCloser(&buf)}
+		if err := decodeBody(res); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil || string(b) != cachedPage {
+			t.Errorf("Expected the deflate body with zlib header %t to be decoded but got %d bytes and %v", zlibHeader, len(b), err)
+		}
+	}
+
+	res := &http.Response{Header: http.Header{"Content-Encoding": {"deflate"}}, Body: http.NoBody}
+	if err := decodeBody(res); err != nil {
+		t.Errorf("Expected an empty deflate body to be ignored but got %s", err.Error())
+	}
+}
@@ -0,0 +1,158 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// StepFunc is a custom step function registered by RegisterStepType. It's called when the steps of a job are parsed
+// with a StepBuilder for the step the keyword was declared in and the arguments a following the keyword.
+type StepFunc func(b *StepBuilder, a string) error
+
+// StepHook is a hook added to a step by a custom step function. It's called while the step is run.
+// Returning an error fails the step.
+type StepHook func(c *StepContext) error
+
+// StepBuilder is the handle custom step functions use to build the step their keyword was declared in.
+type StepBuilder struct {
+	j *job
+	s *step
+}
+
+// StepContext gives a StepHook access to the variables of the job and the request and response of the step.
+// Response and Body are nil in BeforeRequest hooks. Body is the response body read according to the response mode of the step.
+type StepContext struct {
+	Request  *http.Request
+	Response *http.Response
+	Body     []byte
+
+	j *job
+}
+
+// RegisterStepType registers the custom step function f for the keyword name, so that it can be used in the steps
+// of jobs added after it. Keywords are case insensitive and can't replace the built-in ones.
+// Returns error.
+func (srv *Server) RegisterStepType(name string, f StepFunc) error {
+	name = strings.ToLower(name)
+
+	switch {
+	case srv.running:
+		return fmt.Errorf("Couldn't register step type in *Server.RegisterStepType. The Server is already running")
+
+	case name == "" || strings.ContainsAny(name, " \t\n"):
+		return fmt.Errorf("Couldn't register step type in *Server.RegisterStepType. The name is empty or contains spaces")
+
+	case f == nil:
+		return fmt.Errorf("Couldn't register step type %s in *Server.RegisterStepType. The function is nil", name)
+	}
+
+	if _, ok := stepTypes[name]; ok {
+		return fmt.Errorf("Couldn't register step type %s in *Server.RegisterStepType. It's a built-in step type", name)
+	}
+
+	if srv.stepTypes == nil {
+		srv.stepTypes = make(map[string]StepFunc)
+	}
+	srv.stepTypes[name] = f
+	return nil
+}
+
+// customStepType will return the custom step function registered for keyword t as a step type function.
+// A keyword declaring itself through Statement, directly or through other keywords, fails instead of recursing forever.
+// Returns func(*job, *step, *string) error and true if it was registered.
+func (j *job) customStepType(t string) (func(*job, *step, *string) error, bool) {
+	if j.srv == nil || j.srv.stepTypes[t] == nil {
+		return nil, false
+	}
+
+	f := j.srv.stepTypes[t]
+	return func(j *job, s *step, a *string) error {
+		if j.customSteps[t] {
+			return fmt.Errorf("%s was declared but it recurses into itself in *job.customStepType. Raw %s", t, *a)
+		}
+
+		if j.customSteps == nil {
+			j.customSteps = make(map[string]bool)
+		}
+		j.customSteps[t] = true
+		defer delete(j.customSteps, t)
+
+		err := f(&StepBuilder{j: j, s: s}, *a)
+		if err != nil {
+			return fmt.Errorf("%s was declared but the custom step function failed in *job.customStepType. %s. Raw %s", t, err.Error(), *a)
+		}
+		return nil
+	}, true
+}
+
+// Statement will add the statement l to the step as if it was written on its own line, for example `header { "name": "X-Tenant", "value": "1" }`
+// or `get https://example.com`. Any built-in or custom step type can be used.
+// Returns error.
+func (b *StepBuilder) Statement(l string) error {
+	return b.j.createStepLine(b.s, &l)
+}
+
+// Var will return the value of the variable name of the job, or an empty string if it isn't set.
+// Variables set by varfrom statements aren't set until the job is run, use a StepHook for those.
+// Returns string.
+func (b *StepBuilder) Var(name string) string {
+	return b.j.vars[name]
+}
+
+// SetVar will set the variable name of the job to value.
+func (b *StepBuilder) SetVar(name string, value string) {
+	b.j.vars[name] = value
+}
+
+// BeforeRequest will add the hook h to the step. It's called after the request was created with the auth, headers
+// and cookies of the step, but before it's signed and sent. Only HTTP, graphql and sse steps run hooks.
+func (b *StepBuilder) BeforeRequest(h StepHook) {
+	b.s.beforeRequest = append(b.s.beforeRequest, h)
+}
+
+// AfterResponse will add the hook h to the step. It's called after the response passed the error policy and
+// expectations of the step and the variables were set from it. Only HTTP, graphql and sse steps run hooks,
+// where Body is the data of the matched event for sse steps.
+func (b *StepBuilder) AfterResponse(h StepHook) {
+	b.s.afterResponse = append(b.s.afterResponse, h)
+}
+
+// Var will return the value of the variable name of the job, or an empty string if it isn't set.
+// Returns string.
+func (c *StepContext) Var(name string) string {
+	return c.j.vars[name]
+}
+
+// SetVar will set the variable name of the job to value, so that it can be used by the following steps.
+func (c *StepContext) SetVar(name string, value string) {
+	c.j.vars[name] = value
+}
+
+// checkHooks will check that step s can run the hooks added to it. ws and grpc steps don't have a HTTP request
+// and response for the hooks, so adding hooks to them is an error.
+// Returns error.
+func (*job) checkHooks(s *step) error {
+	if len(s.beforeRequest) == 0 && len(s.afterResponse) == 0 {
+		return nil
+	}
+
+	switch s.method {
+	case "WS", "GRPC":
+		return fmt.Errorf("Hooks were added to a %s step in *job.checkHooks. Only HTTP, graphql and sse steps run hooks", strings.ToLower(s.method))
+	}
+	return nil
+}
+
+// runHooks will call the hooks h with the StepContext c and stop at the first one that fails.
+// Returns error.
+func (*job) runHooks(h []StepHook, c *StepContext) error {
+	for _, hook := range h {
+		err := hook(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package steptest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newOrderServer will start a server that answers with order placed and the header X-Order set to o- and the query n.
+// The X-Tenant and X-Trace headers of the last request are stored in tenant and trace.
+func newOrderServer(tenant *string, trace *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*tenant, *trace = r.Header.Get("X-Tenant"), r.Header.Get("X-Trace")
+		w.Header().Set("X-Order", "o-"+r.URL.Query().Get("n"))
+		w.Write([]byte("order placed"))
+	}))
+}
+
+// registerTrace will register the keyword trace, which adds hooks that set the X-Trace header to the arguments and the
+// variable n, and the variable order from the X-Order header of the response. The response must contain placed.
+func registerTrace(t *testing.T, srv *Server) {
+	err := srv.RegisterStepType("trace", func(b *StepBuilder, a string) error {
+		b.BeforeRequest(func(c *StepContext) error {
+			c.Request.Header.Set("X-Trace", a+"-"+c.Var("n"))
+			return nil
+		})
+		b.AfterResponse(func(c *StepContext) error {
+			if !strings.Contains(string(c.Body), "placed") {
+				return fmt.Errorf("order not placed")
+			}
+			c.SetVar("order", c.Response.Header.Get("X-Order"))
+			return nil
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterStepType(t *testing.T) {
+	var tenant, trace string
+	ts := newOrderServer(&tenant, &trace)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+
+	// tenant adds a header and sets a variable when the steps are parsed.
+	err := srv.RegisterStepType("Tenant", func(b *StepBuilder, a string) error {
+		if a == "" {
+			return fmt.Errorf("tenant id missing")
+		}
+		b.SetVar("tenant", a)
+		return b.Statement(`header { "name": "X-Tenant", "value": "{{tenant}}" }`)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := srv.parseJob(&rawJob{steps: "- tenant acme\n- get " + ts.URL + "\n  tenant acme\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	if tenant != "acme" {
+		t.Errorf("Expected tenant acme but got %s", tenant)
+	}
+
+	if _, err := srv.parseJob(&rawJob{steps: "- tenant\n"}); err == nil || !strings.Contains(err.Error(), "tenant id missing") {
+		t.Errorf("Expected error from the custom step function but got %v", err)
+	}
+}
+
+func TestRegisterStepTypeInvalid(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+
+	for _, name := range []string{"get", "", "two words"} {
+		if err := srv.RegisterStepType(name, func(*StepBuilder, string) error { return nil }); err == nil {
+			t.Errorf("Expected error registering %q but got nil", name)
+		}
+	}
+
+	srv.running = true
+	if err := srv.RegisterStepType("late", func(*StepBuilder, string) error { return nil }); err == nil {
+		t.Errorf("Expected error registering a step type while running but got nil")
+	}
+}
+
+func TestStepTypeRecursion(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+
+	srv.RegisterStepType("loop", func(b *StepBuilder, a string) error { return b.Statement("loop " + a) })
+	srv.RegisterStepType("ping", func(b *StepBuilder, a string) error { return b.Statement("pong") })
+	srv.RegisterStepType("pong", func(b *StepBuilder, a string) error { return b.Statement("ping") })
+	srv.RegisterStepType("twice", func(b *StepBuilder, a string) error {
+		if err := b.Statement(`header { "name": "X-A", "value": "1" }`); err != nil {
+			return err
+		}
+		return b.Statement(`header { "name": "X-B", "value": "2" }`)
+	})
+
+	for _, k := range []string{"loop", "ping"} {
+		if _, err := srv.parseJob(&rawJob{steps: "- get http://example.com\n  " + k + "\n"}); err == nil || !strings.Contains(err.Error(), "recurses into itself") {
+			t.Errorf("Expected error for %s recursing into itself but got %v", k, err)
+		}
+	}
+
+	// The same keyword can be used more than once as long as it doesn't declare itself.
+	j, err := srv.parseJob(&rawJob{steps: "- get http://example.com\n  twice\n  twice\n"})
+	if err != nil || len(j.steps[0].headers) != 4 {
+		t.Errorf("Expected 4 headers from twice used twice but got %v", err)
+	}
+}
+
+func TestStepHooks(t *testing.T) {
+	var tenant, trace string
+	ts := newOrderServer(&tenant, &trace)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+	registerTrace(t, srv)
+
+	j, err := srv.parseJob(&rawJob{steps: "- get " + ts.URL + "?n={{n}}\n  trace checkout\n", vars: map[string]string{"n": "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	if trace != "checkout-1" || j.vars["order"] != "o-1" {
+		t.Errorf("Expected trace checkout-1 and order o-1 but got %s and %s", trace, j.vars["order"])
+	}
+}
+
+func TestStepHooksInForLoop(t *testing.T) {
+	var tenant, trace string
+	ts := newOrderServer(&tenant, &trace)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+	err := srv.RegisterStepType("fail", func(b *StepBuilder, a string) error {
+		b.AfterResponse(func(c *StepContext) error { return fmt.Errorf("rejected %s", c.Var("n")) })
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hooks are called with a failing response in for loops too.
+	j, _ := srv.parseJob(&rawJob{steps: "- array { \"name\": \"ns\", \"values\": [\"2\"] }\n- for n in {{ns}}\n  get " + ts.URL + "\n  fail\n  forend\n"})
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err == nil || !strings.Contains(r.Err.Error.Error(), "rejected 2") {
+		t.Errorf("Expected the AfterResponse hook to fail the step but got %v", r.Err)
+	}
+}
+
+func TestStepHooksSSE(t *testing.T) {
+	var trace string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace = r.Header.Get("X-Trace")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("X-Order", "o-2")
+		w.Write([]byte("data: order placed\n\n"))
+	}))
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+	registerTrace(t, srv)
+
+	j, err := srv.parseJob(&rawJob{steps: "- sse " + ts.URL + "\n  trace stream\n", vars: map[string]string{"n": "2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	if trace != "stream-2" || j.vars["order"] != "o-2" {
+		t.Errorf("Expected trace stream-2 and order o-2 but got %s and %s", trace, j.vars["order"])
+	}
+}
+
+func TestStepHooksUnsupported(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+	registerTrace(t, srv)
+
+	for _, a := range []string{"ws connect ws://example.com", "grpc grpc://example.com/inventory.Inventory/GetStock"} {
+		if _, err := srv.parseJob(&rawJob{steps: "- " + a + "\n  trace checkout\n"}); err == nil || !strings.Contains(err.Error(), "Hooks were added") {
+			t.Errorf("Expected error for hooks on %s but got %v", a, err)
+		}
+	}
+}
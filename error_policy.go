@@ -0,0 +1,172 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+var (
+	// Allowed transport error classes for the errors statement.
+	allowedTransportErrors = []string{"timeout", "dns", "refused", "reset", "tls", "other"}
+
+	// defaultErrorStatuses are the status codes that are failures unless anything else has been configured.
+	defaultErrorStatuses = []statusRange{{400, 999}}
+)
+
+// errorPolicy contains which responses and transport errors that should count as failures.
+// A policy can be set on the Server, the job and the step. Any value that isn't set will
+// fall back to the value of the previous level, with the step taking precedence over the job
+// and the job taking precedence over the Server.
+type errorPolicy struct {
+	Statuses  string   `json:"statuses"`
+	Transport []string `json:"transport"`
+	Body      string   `json:"body"`
+	Soft      *bool    `json:"soft"`
+
+	statuses []statusRange
+	body     *regexp.Regexp
+}
+
+// parse will validate the error policy e and parse its statuses, transport error classes and body pattern.
+// Returns error.
+func (e *errorPolicy) parse() error {
+	var err error
+
+	if e.Statuses != "" {
+		e.statuses, err = parseStatusRanges(e.Statuses)
+		if err != nil {
+			return err
+		}
+	}
+
+	if e.Body != "" {
+		e.body, err = regexp.Compile(e.Body)
+		if err != nil {
+			return fmt.Errorf("Couldn't compile body regular expression. %s", err.Error())
+		}
+	}
+
+	for i, t := range e.Transport {
+		e.Transport[i] = strings.ToLower(t)
+		if e.Transport[i] == "all" {
+			continue
+		}
+
+		supported := false
+		for _, allowed := range allowedTransportErrors {
+			if e.Transport[i] == allowed {
+				supported = true
+			}
+		}
+
+		if !supported {
+			return fmt.Errorf("Transport error class %s is not supported. Supported classes are all and %s", t, allowedTransportErrors)
+		}
+	}
+
+	return nil
+}
+
+// merge will return a copy of error policy e where all values that are set in error policy o has been overwritten.
+// Returns errorPolicy.
+func (e errorPolicy) merge(o *errorPolicy) errorPolicy {
+	if o.statuses != nil {
+		e.Statuses, e.statuses = o.Statuses, o.statuses
+	}
+
+	if o.Transport != nil {
+		e.Transport = o.Transport
+	}
+
+	if o.body != nil {
+		e.Body, e.body = o.Body, o.body
+	}
+
+	if o.Soft != nil {
+		e.Soft = o.Soft
+	}
+
+	return e
+}
+
+// isErrorStatus returns true if status code c should count as a failure.
+// Returns bool.
+func (e *errorPolicy) isErrorStatus(c int) bool {
+	if e.statuses == nil {
+		return matchStatus(defaultErrorStatuses, c)
+	}
+	return matchStatus(e.statuses, c)
+}
+
+// isTransportError returns true if the transport error err should count as a failure.
+// Returns bool.
+func (e *errorPolicy) isTransportError(err error) bool {
+	if e.Transport == nil {
+		return true
+	}
+
+	class := classifyTransportError(err)
+	for _, t := range e.Transport {
+		if t == "all" || t == class {
+			return true
+		}
+	}
+	return false
+}
+
+// isSoft returns true if failures should be recorded without stopping the job.
+// Returns bool.
+func (e *errorPolicy) isSoft() bool {
+	return e.Soft != nil && *e.Soft
+}
+
+// classifyTransportError will classify the error err from sending a request as either
+// timeout, dns, refused, reset, tls or other.
+// Returns string.
+func classifyTransportError(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "reset"
+
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &unknownAuthErr), errors.As(err, &hostnameErr):
+		return "tls"
+	}
+
+	return "other"
+}
+
+// errorPolicy will return the error policy to use for step s by merging the Servers, the jobs j and the steps policies.
+// Returns errorPolicy.
+func (j *job) errorPolicy(s *step) errorPolicy {
+	e := errorPolicy{}
+	if j.srv != nil {
+		e = e.merge(&j.srv.errorPolicy)
+	}
+	return e.merge(&j.globalErrorPolicy).merge(&s.errorPolicy)
+}
@@ -0,0 +1,111 @@
+package steptest
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorPolicy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cart/item":
+			w.WriteHeader(http.StatusNotFound)
+
+		case "/checkout":
+			w.Write([]byte("<h1>An error occurred</h1>"))
+
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	srv, err := New(1, 5000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.SetErrorBody("An error occurred"); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := "- @errors { \"soft\": true }\n"
+	steps += "  delete " + ts.URL + "/cart/item\n"
+	steps += "  errors { \"statuses\": \"5xx\", \"soft\": false }\n"
+	steps += "- get " + ts.URL + "/checkout\n"
+	steps += "- get " + ts.URL + "/broken\n"
+
+	j, err := srv.parseJob(&rawJob{steps: steps})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err != nil {
+		t.Fatalf("Expected no error but got %s", r.Err.Error)
+	}
+
+	if len(r.Steps) != 3 {
+		t.Errorf("Expected the job to continue and run %d steps but got %d", 3, len(r.Steps))
+	}
+
+	if len(r.SoftErrors) != 2 {
+		t.Fatalf("Expected %d soft errors but got %d", 2, len(r.SoftErrors))
+	}
+
+	if r.SoftErrors[0].URL != ts.URL+"/checkout" || r.SoftErrors[1].Status != 500 {
+		t.Errorf("Expected soft errors for %s and status %d but got %s and %d", ts.URL+"/checkout", 500, r.SoftErrors[0].URL, r.SoftErrors[1].Status)
+	}
+}
+
+func TestTransportErrorPolicy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	srv, err := New(1, 5000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.SetTransportErrors("timeout"); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := srv.parseJob(&rawJob{steps: "- get http://" + addr + "/\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err != nil {
+		t.Errorf("Expected refused connection to not count as a failure but got %s", r.Err.Error)
+	}
+
+	if r.Status != -1 {
+		t.Errorf("Expected status to be %d but got %d", -1, r.Status)
+	}
+
+	if err := srv.SetTransportErrors("refused"); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = srv.parseJob(&rawJob{steps: "- get http://" + addr + "/\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = srv.fetchJob(j, srv.fetchFunc)
+	if r.Err == nil {
+		t.Errorf("Expected refused connection to count as a failure but got nil")
+	}
+
+	if err := srv.SetTransportErrors("sometimes"); err == nil {
+		t.Errorf("Expected error for unsupported transport error class but got nil")
+	}
+}
@@ -0,0 +1,130 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// graphQL is the query, operation name and variables of a graphql step, which are sent as a JSON body.
+type graphQL struct {
+	query     string
+	operation string
+	variables string
+}
+
+// graphQLResponse contains the errors of a GraphQL response.
+type graphQLResponse struct {
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// createGraphQL will create a GraphQL POST step based on step s and args a, which is the URL followed by the query.
+// The query is usually written on the lines after the URL, indented deeper than the statements of the step.
+// Returns error.
+func createGraphQL(j *job, s *step, a *string) error {
+	v := strings.Trim(*a, trim)
+	i := strings.IndexAny(v, " \t\n")
+
+	switch {
+	case v == "":
+		return fmt.Errorf("graphql was declared but URL was not supplied in createGraphQL. Raw %s", *a)
+
+	case i == -1 || strings.TrimSpace(v[i:]) == "":
+		return fmt.Errorf("graphql was declared but the query was not supplied in createGraphQL. Raw %s", *a)
+
+	case !strings.HasPrefix(v, "http://") && !strings.HasPrefix(v, "https://") && !strings.HasPrefix(v, "{{"):
+		return fmt.Errorf("graphql was declared but the URL isn't http:// or https:// in createGraphQL. Raw %s", *a)
+	}
+
+	s.graphql = &graphQL{query: strings.TrimSpace(v[i:])}
+	s.method = "POST"
+	s.url = v[:i]
+	return nil
+}
+
+// createOperation will set the operation name of the GraphQL step s from args a. The operation name
+// picks which operation to run when the query contains more than one. Jobs j will be ignored.
+// Returns error.
+func createOperation(j *job, s *step, a *string) error {
+	v := strings.Trim(*a, trim)
+
+	switch {
+	case s.graphql == nil:
+		return fmt.Errorf("operation was declared but the step isn't a graphql step in createOperation. Raw %s", *a)
+
+	case v == "" || strings.ContainsAny(v, " \t\n"):
+		return fmt.Errorf("operation was declared but the name is empty or contains spaces in createOperation. Raw %s", *a)
+	}
+
+	s.graphql.operation = v
+	return nil
+}
+
+// createVariables will set the variables of the GraphQL step s from the JSON object in args a.
+// Placeholders are replaced when the step is run, so the object is only validated if it doesn't contain any.
+// Jobs j will be ignored.
+// Returns error.
+func createVariables(j *job, s *step, a *string) error {
+	v := strings.TrimSpace(*a)
+
+	switch {
+	case s.graphql == nil:
+		return fmt.Errorf("variables was declared but the step isn't a graphql step in createVariables. Raw %s", *a)
+
+	case !strings.HasPrefix(v, "{"):
+		return fmt.Errorf("variables was declared but it isn't a JSON object in createVariables. Raw %s", *a)
+
+	case !strings.Contains(v, "{{") && !json.Valid([]byte(v)):
+		return fmt.Errorf("variables was declared but we couldn't unmarshal it in createVariables. Raw %s", *a)
+	}
+
+	s.graphql.variables = v
+	return nil
+}
+
+// graphQLBody will create the JSON body of the GraphQL request g from the query, operation name and variables
+// after the variables of the job j were replaced in them. Placeholders without quotes in the variables are
+// replaced as is so that they can be replaced by numbers or objects, while values inside strings are JSON escaped.
+// Returns string.
+func (j *job) graphQLBody(g *graphQL) string {
+	query, _ := json.Marshal(j.replaceVariables(g.query))
+	b := `{"query":` + string(query)
+
+	if g.operation != "" {
+		operation, _ := json.Marshal(j.replaceVariables(g.operation))
+		b += `,"operationName":` + string(operation)
+	}
+
+	if g.variables != "" {
+		b += `,"variables":` + j.replaceJSONVariables(g.variables)
+	}
+
+	return b + "}"
+}
+
+// graphQLError will check the already read body raw of the response res to the GraphQL step s for errors.
+// A non-empty errors array fails the step even if the status code was 200. Bodies that aren't JSON,
+// such as when the response is discarded, are left to the expectations of the step.
+// Returns *ResultError.
+func (*job) graphQLError(s *step, res *http.Response, raw []byte) *ResultError {
+	r := new(graphQLResponse)
+	if err := json.Unmarshal(raw, r); err != nil || len(r.Errors) == 0 {
+		return nil
+	}
+
+	messages := []string{}
+	for _, e := range r.Errors {
+		messages = append(messages, e.Message)
+	}
+
+	return &ResultError{
+		Error:  fmt.Errorf("%d %s %s graphql errors: %s", res.StatusCode, s.method, s.url, strings.Join(messages, "; ")),
+		URL:    s.url,
+		Status: res.StatusCode,
+		Body:   bodyExcerpt(raw),
+	}
+}
@@ -0,0 +1,169 @@
+package steptest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// graphQLRequest is the JSON body of a GraphQL request.
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// newCartServer will start a GraphQL server that answers with a cart, or with an errors array for the id missing.
+// The last request and its Content-Type are stored in received and contentType.
+func newCartServer(received *graphQLRequest, contentType *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*contentType = r.Header.Get("Content-Type")
+		*received = graphQLRequest{}
+		if err := json.NewDecoder(r.Body).Decode(received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if received.Variables["id"] == "missing" {
+			w.Write([]byte(`{"data":{"cart":null},"errors":[{"message":"cart not found","path":["cart"]}]}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"cart":{"id":"c1","items":[{"sku":"sku-1","qty":2}]}}}`))
+	}))
+}
+
+func TestGraphQL(t *testing.T) {
+	var received graphQLRequest
+	var contentType string
+	ts := newCartServer(&received, &contentType)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+
+	steps := "- var { \"name\": \"cart\", \"value\": \"c1\" }\n"
+	steps += "- graphql " + ts.URL + "\n"
+	steps += "    query Cart($id: ID!, $first: Int) {\n"
+	steps += "      cart(id: $id) { id items(first: $first) { sku qty } }\n"
+	steps += "    }\n"
+	steps += "    query Other { viewer { id } }\n"
+	steps += "  operation Cart\n"
+	steps += "  variables { \"id\": \"{{cart}}\", \"first\": {{first}} }\n"
+	steps += "  varfrom { \"from\": \"json\", \"name\": \"sku\", \"find\": \"data.cart.items[0].sku\" }\n"
+	steps += "  varfrom { \"from\": \"json\", \"name\": \"items\", \"find\": \"data.cart.items\" }\n"
+	steps += "  expect { \"type\": \"json\", \"path\": \"data.cart.items[0].qty\", \"value\": \"2\" }\n"
+
+	j, err := srv.parseJob(&rawJob{steps: steps, vars: map[string]string{"first": "5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	if !strings.HasPrefix(received.Query, "query Cart($id: ID!, $first: Int) {\n") || !strings.Contains(received.Query, "}\n  query Other") {
+		t.Errorf("Expected the multi-line query to be sent but got %q", received.Query)
+	}
+
+	if received.OperationName != "Cart" || received.Variables["id"] != "c1" || received.Variables["first"] != float64(5) || contentType != "application/json" {
+		t.Errorf("Expected operation Cart with variables c1 and 5 as application/json but got %s, %v and %s", received.OperationName, received.Variables, contentType)
+	}
+
+	if j.vars["sku"] != "sku-1" || j.vars["items"] != `[{"qty":2,"sku":"sku-1"}]` {
+		t.Errorf("Expected sku-1 and the items array from data but got %s and %s", j.vars["sku"], j.vars["items"])
+	}
+}
+
+func TestGraphQLErrors(t *testing.T) {
+	var received graphQLRequest
+	var contentType string
+	ts := newCartServer(&received, &contentType)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+
+	// An errors array fails the step even though the status code is 200.
+	j, _ := srv.parseJob(&rawJob{steps: "- graphql " + ts.URL + " query { cart(id: \"missing\") { id } }\n  variables { \"id\": \"missing\" }\n"})
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err == nil || r.Err.Status != 200 || !strings.Contains(r.Err.Error.Error(), "cart not found") {
+		t.Errorf("Expected the graphql errors to fail the step but got %v", r.Err)
+	}
+}
+
+func TestGraphQLEscaping(t *testing.T) {
+	var received graphQLRequest
+	var contentType string
+	ts := newCartServer(&received, &contentType)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+
+	for _, value := range []string{`a"b`, `a\b`, "a\nb", `x", "admin": "true`} {
+		t.Run(value, func(t *testing.T) {
+			steps := "- graphql " + ts.URL + " query { cart(note: \"{{value}}\") { id } }\n"
+			steps += "  variables { \"id\": \"{{value}}\", \"first\": {{first}} }\n"
+
+			j, err := srv.parseJob(&rawJob{steps: steps, vars: map[string]string{"value": value, "first": "5"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+				t.Fatal(r.Err.Error)
+			}
+
+			if received.Variables["id"] != value || received.Variables["first"] != float64(5) || len(received.Variables) != 2 {
+				t.Errorf("Expected the variables id %q and first 5 but got %v", value, received.Variables)
+			}
+
+			if received.Query != "query { cart(note: \""+value+"\") { id } }" {
+				t.Errorf("Expected the value %q in the query but got %q", value, received.Query)
+			}
+		})
+	}
+}
+
+func TestStepContinuation(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+
+	for _, test := range []struct {
+		name      string
+		steps     string
+		url       string
+		headers   int
+		variables string
+	}{
+		{"deeper indented statement", "- get http://example.com/a\n    header { \"name\": \"X-A\", \"value\": \"1\" }\n", "http://example.com/a", 1, ""},
+		{"graphql query", "- graphql http://example.com/graphql\n    query {\n      id\n    }\n  header { \"name\": \"X-A\", \"value\": \"1\" }\n", "http://example.com/graphql", 1, ""},
+		{"graphql variables", "- graphql http://example.com/graphql { id }\n  variables {\n    \"id\": 1\n    }\n", "http://example.com/graphql", 0, "{\n  \"id\": 1\n  }"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			j, err := srv.parseJob(&rawJob{steps: test.steps})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := j.steps[0]
+			if s.url != test.url || len(s.headers) != test.headers {
+				t.Errorf("Expected URL %s with %d headers but got %q with %d", test.url, test.headers, s.url, len(s.headers))
+			}
+
+			if test.variables != "" && s.graphql.variables != test.variables {
+				t.Errorf("Expected variables %q but got %q", test.variables, s.graphql.variables)
+			}
+		})
+	}
+}
+
+func TestCreateGraphQL(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+
+	for _, a := range []string{"- graphql http://example.com", "- graphql ftp://example.com { id }", "- get http://example.com\n  operation Cart", "- graphql http://example.com { id }\n  variables [1]", "- graphql http://example.com { id }\n  variables { \"id\": }"} {
+		if _, err := srv.parseJob(&rawJob{steps: a + "\n"}); err == nil {
+			t.Errorf("Expected error for invalid %q but got nil", a)
+		}
+	}
+}
@@ -0,0 +1,555 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	grpcDefaultTimeout = 30 * time.Second // grpcDefaultTimeout is the timeout of a gRPC call if the Server has no timeout.
+)
+
+var (
+	// The HTTP status codes the gRPC status codes are mapped to, so that the error policy and status expectations
+	// can be used for gRPC steps.
+	grpcHTTPStatuses = map[codes.Code]int{
+		codes.OK:                 http.StatusOK,
+		codes.Canceled:           499,
+		codes.Unknown:            http.StatusInternalServerError,
+		codes.InvalidArgument:    http.StatusBadRequest,
+		codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+		codes.NotFound:           http.StatusNotFound,
+		codes.AlreadyExists:      http.StatusConflict,
+		codes.PermissionDenied:   http.StatusForbidden,
+		codes.ResourceExhausted:  http.StatusTooManyRequests,
+		codes.FailedPrecondition: http.StatusBadRequest,
+		codes.Aborted:            http.StatusConflict,
+		codes.OutOfRange:         http.StatusBadRequest,
+		codes.Unimplemented:      http.StatusNotImplemented,
+		codes.Internal:           http.StatusInternalServerError,
+		codes.Unavailable:        http.StatusServiceUnavailable,
+		codes.DataLoss:           http.StatusInternalServerError,
+		codes.Unauthenticated:    http.StatusUnauthorized,
+	}
+)
+
+// createGRPC will create a gRPC step based on step s and args a, which is the URL grpc://host:port/package.Service/Method
+// or grpcs:// for TLS, followed by the JSON encoded request. The request defaults to an empty message.
+// Returns error.
+func createGRPC(j *job, s *step, a *string) error {
+	v := strings.SplitN(strings.Trim(*a, trim), separator, 2)
+
+	u, err := url.Parse(v[0])
+	switch {
+	case v[0] == "":
+		return fmt.Errorf("grpc was declared but URL was not supplied in createGRPC. Raw %s", *a)
+
+	case err != nil || (u.Scheme != "grpc" && u.Scheme != "grpcs") || u.Host == "":
+		return fmt.Errorf("grpc was declared but the URL isn't grpc://host:port or grpcs://host:port in createGRPC. Raw %s", *a)
+
+	case strings.Count(strings.Trim(u.Path, "/"), "/") != 1:
+		return fmt.Errorf("grpc was declared but the URL has no /package.Service/Method path in createGRPC. Raw %s", *a)
+	}
+
+	s.body = "{}"
+	if len(v) > 1 && strings.Trim(v[1], trim) != "" {
+		s.body = v[1]
+	}
+
+	s.method = "GRPC"
+	s.url = v[0]
+	return nil
+}
+
+// createDescriptor will load the descriptor set file in args a and use it for the gRPC step s instead of server reflection.
+// Returns error.
+func createDescriptor(j *job, s *step, a *string) error {
+	files, err := j.loadDescriptorSet(strings.Trim(*a, trim))
+	if err != nil {
+		return fmt.Errorf("descriptor was declared but is invalid in createDescriptor. %s. Raw %s", err.Error(), *a)
+	}
+
+	s.grpcFiles = files
+	return nil
+}
+
+// createGlobalDescriptor will load the descriptor set file in args a and use it for all gRPC steps in the job j
+// instead of server reflection. Step s will be ignored.
+// Returns error.
+func createGlobalDescriptor(j *job, s *step, a *string) error {
+	files, err := j.loadDescriptorSet(strings.Trim(*a, trim))
+	if err != nil {
+		return fmt.Errorf("@descriptor was declared but is invalid in createGlobalDescriptor. %s. Raw %s", err.Error(), *a)
+	}
+
+	j.grpcFiles = files
+	return nil
+}
+
+// loadDescriptorSet will load the descriptor set file f, as written by protoc --descriptor_set_out --include_imports.
+// Descriptor sets are cached on the Server so that every file is only loaded once.
+// Returns *protoregistry.Files and error.
+func (j *job) loadDescriptorSet(f string) (*protoregistry.Files, error) {
+	if f == "" {
+		return nil, fmt.Errorf("FILE was not supplied")
+	}
+
+	srv := j.srv
+	if srv != nil {
+		srv.descriptorMu.Lock()
+		defer srv.descriptorMu.Unlock()
+
+		if files, ok := srv.descriptorSets[f]; ok {
+			return files, nil
+		}
+	}
+
+	b, err := os.ReadFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read descriptor set. %s", err.Error())
+	}
+
+	set := new(descriptorpb.FileDescriptorSet)
+	err = proto.Unmarshal(b, set)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't unmarshal descriptor set. %s", err.Error())
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load descriptor set. %s", err.Error())
+	}
+
+	if srv != nil {
+		if srv.descriptorSets == nil {
+			srv.descriptorSets = make(map[string]*protoregistry.Files)
+		}
+		srv.descriptorSets[f] = files
+	}
+
+	return files, nil
+}
+
+// grpcStep will call the unary gRPC method of step s with the JSON encoded request in the body of the step. Headers and
+// auth are sent as metadata. The response is encoded as JSON and used as the body by any varfrom and expect statements,
+// and the response metadata as headers. The gRPC status is mapped to a HTTP status code, so that the error policy and
+// status expectations apply. The timing of the call is stored in s.timing.
+// Returns the mapped status code and *ResultError.
+func (j *job) grpcStep(c func(*http.Request) (*http.Response, error), s *step) (int, *ResultError) {
+	if !j.checkConditions(s) {
+		return 0, nil
+	}
+
+	j.replaceFromVariables(s)
+	policy := j.errorPolicy(s)
+
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("Couldn't parse the URL in *job.grpcStep. %s", err.Error()), URL: s.url, Status: -1}
+	}
+	service, method := grpcServiceMethod(u.Path)
+
+	// gRPC connections use their own dialer, so a proxy would silently be bypassed.
+	if p := j.proxy(); p != "" && p != "none" {
+		return -1, &ResultError{Error: fmt.Errorf("Couldn't use the proxy %s in *job.grpcStep. Proxies aren't supported for gRPC steps", p), URL: s.url, Status: -1}
+	}
+
+	timeout := grpcDefaultTimeout
+	if j.srv != nil && j.srv.timeout > 0 {
+		timeout = j.srv.timeout
+	}
+
+	conn, err := j.grpcConns.get(j, u)
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("Couldn't create the gRPC connection in *job.grpcStep. %s", err.Error()), URL: s.url, Status: -1}
+	}
+
+	// The method is looked up before the call is timed, since server reflection is only needed once per Server.
+	md, err := j.grpcMethod(conn.ClientConn, u, s, service, method, timeout)
+	if err != nil {
+		if terr := conn.transportError(err); terr != nil {
+			if !policy.isTransportError(terr) {
+				return -1, nil
+			}
+			return -1, &ResultError{Error: fmt.Errorf("Couldn't find the gRPC method in *job.grpcStep. %w", terr), URL: s.url, Status: -1}
+		}
+
+		st := status.Convert(err)
+		s.grpcStatus = st.Code().String()
+		code := grpcHTTPStatuses[st.Code()]
+		if !policy.isErrorStatus(code) {
+			return code, nil
+		}
+		return code, &ResultError{Error: fmt.Errorf("Couldn't find the gRPC method in *job.grpcStep. %s", st.Message()), URL: s.url, Status: code, Body: st.Message()}
+	}
+
+	start := time.Now()
+	defer func() {
+		s.timing.Total = time.Now().Sub(start)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req := dynamicpb.NewMessage(md.Input())
+	err = protojson.Unmarshal([]byte(s.body), req)
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("Couldn't unmarshal the request in *job.grpcStep. %s", err.Error()), URL: s.url, Status: -1}
+	}
+
+	// The auth and headers are added to a HTTP request, so that they can be sent as metadata.
+	hreq, _ := http.NewRequest("POST", "http://"+u.Host+u.Path, nil)
+	err = j.addAuth(c, s, hreq)
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("Couldn't add auth to the Request in *job.grpcStep. %s", err.Error()), URL: s.url, Status: -1}
+	}
+	j.addHeaders(s, hreq)
+
+	outgoing := metadata.MD{}
+	for name, values := range hreq.Header {
+		outgoing.Append(strings.ToLower(name), values...)
+	}
+	ctx = metadata.NewOutgoingContext(ctx, outgoing)
+
+	res := dynamicpb.NewMessage(md.Output())
+	var header, trailer metadata.MD
+	err = conn.Invoke(ctx, u.Path, req, res, grpc.Header(&header), grpc.Trailer(&trailer))
+	d := time.Now().Sub(start)
+
+	st := status.Convert(err)
+	s.grpcStatus = st.Code().String()
+	s.bytesSent = int64(proto.Size(req))
+
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%w %w", err, ctx.Err())
+	}
+	if terr := conn.transportError(err); terr != nil {
+		if !policy.isTransportError(terr) {
+			return -1, nil
+		}
+		return -1, &ResultError{Error: fmt.Errorf("Error calling the gRPC method in *job.grpcStep. %w", terr), URL: s.url, Status: -1}
+	}
+
+	raw := []byte{}
+	if err == nil {
+		raw, err = protojson.Marshal(res)
+		if err != nil {
+			return -1, &ResultError{Error: fmt.Errorf("Couldn't marshal the response in *job.grpcStep. %s", err.Error()), URL: s.url, Status: -1}
+		}
+		s.bytesReceived = int64(proto.Size(res))
+	}
+
+	response := &http.Response{StatusCode: grpcHTTPStatuses[st.Code()], Header: http.Header{}, Request: hreq}
+	for _, m := range []metadata.MD{header, trailer} {
+		for name, values := range m {
+			response.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	if !s.expectsStatus() && policy.isErrorStatus(response.StatusCode) {
+		return response.StatusCode, &ResultError{Error: fmt.Errorf("%d %s %s %s %s", response.StatusCode, s.method, s.url, st.Code(), st.Message()), URL: s.url, Status: response.StatusCode, Body: st.Message()}
+	}
+
+	if policy.body != nil && policy.body.Match(raw) {
+		return response.StatusCode, &ResultError{Error: fmt.Errorf("%d %s %s body matches %s", response.StatusCode, s.method, s.url, policy.Body), URL: s.url, Status: response.StatusCode, Body: bodyExcerpt(raw)}
+	}
+
+	resErr := j.checkExpectations(s, response, &raw, d)
+	if resErr != nil {
+		return response.StatusCode, resErr
+	}
+
+	return response.StatusCode, j.variablesFrom(s, response, &raw, d)
+}
+
+// grpcServiceMethod will split the path p of a gRPC URL into the full name of the service and the method.
+// Returns the service and the method.
+func grpcServiceMethod(p string) (string, string) {
+	v := strings.SplitN(strings.Trim(p, "/"), "/", 2)
+	if len(v) < 2 {
+		return v[0], ""
+	}
+	return v[0], v[1]
+}
+
+// grpcConnSet contains gRPC connections by target and the settings of the job that dialed them.
+// Which virtual users that share a grpcConnSet is decided by the connection model of the Server.
+type grpcConnSet struct {
+	mu    sync.Mutex
+	conns map[grpcConnKey]*grpcConn
+}
+
+// grpcConn contains a gRPC connection and the error of its latest dial, since gRPC only reports
+// failed dials as an Unavailable status without the underlying error.
+type grpcConn struct {
+	*grpc.ClientConn
+
+	mu      sync.Mutex
+	dialErr error
+}
+
+// grpcConnKey contains the target and the settings that needs a gRPC connection of their own.
+type grpcConnKey struct {
+	target    string
+	tls       *tls.Config
+	resolve   string
+	network   networkShape
+	bandwidth *bandwidth
+}
+
+// newGRPCConnSet will create a new empty grpcConnSet.
+// Returns *grpcConnSet.
+func newGRPCConnSet() *grpcConnSet {
+	return &grpcConnSet{conns: make(map[grpcConnKey]*grpcConn)}
+}
+
+// get will return the gRPC connection to the host of URL u for the job j, creating it if it doesn't exist.
+// Connections are dialed with the TLS config, DNS overrides and network shape of the job.
+// Returns *grpcConn and error.
+func (cs *grpcConnSet) get(j *job, u *url.URL) (*grpcConn, error) {
+	key := grpcConnKey{target: u.Scheme + "://" + u.Host, tls: j.tlsConfig(), resolve: j.resolveKey(), network: j.network(), bandwidth: j.bandwidth()}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if conn, ok := cs.conns[key]; ok {
+		return conn, nil
+	}
+
+	creds := insecure.NewCredentials()
+	if u.Scheme == "grpcs" {
+		cfg := &tls.Config{}
+		if key.tls != nil {
+			cfg = key.tls.Clone()
+		}
+		creds = credentials.NewTLS(cfg)
+	}
+
+	conn := &grpcConn{}
+	dial := j.dialContext()
+	cc, err := grpc.NewClient(
+		"passthrough:///"+u.Host,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			c, err := dial(ctx, "tcp", addr)
+			conn.mu.Lock()
+			conn.dialErr = err
+			conn.mu.Unlock()
+			return c, err
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.ClientConn = cc
+	cs.conns[key] = conn
+	return conn, nil
+}
+
+// transportError will return the connection-level failure of the gRPC error err, or nil if err is nil or was
+// returned by the server. Timeouts and Unavailable statuses are connection-level failures, and the latest failed
+// dial of the connection conn is wrapped so that the error can be classified by the error policy.
+// Returns error.
+func (conn *grpcConn) transportError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+
+	case errors.Is(err, context.DeadlineExceeded):
+		return err
+
+	case status.Code(err) != codes.Unavailable:
+		return nil
+	}
+
+	conn.mu.Lock()
+	dialErr := conn.dialErr
+	conn.mu.Unlock()
+
+	if dialErr != nil {
+		return fmt.Errorf("%s %w", status.Convert(err).Message(), dialErr)
+	}
+	return err
+}
+
+// close will close all gRPC connections of the grpcConnSet cs.
+// Should be called when the scope of the grpcConnSet has ended.
+func (cs *grpcConnSet) close() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for key, conn := range cs.conns {
+		conn.Close()
+		delete(cs.conns, key)
+	}
+}
+
+// grpcConnsForWorker will return the gRPC connections a worker should use based on the connection model.
+// Returns *grpcConnSet and a function to call when the worker is done.
+func (srv *Server) grpcConnsForWorker() (*grpcConnSet, func()) {
+	if srv.connectionModel != "worker" {
+		return srv.grpcConns, func() {}
+	}
+
+	cs := newGRPCConnSet()
+	return cs, cs.close
+}
+
+// grpcConnsForJob will return the gRPC connections a job should use based on the connection model.
+// Worker connections cs will be used unless every job should have its own connections.
+// Returns *grpcConnSet and a function to call when the job is done.
+func (srv *Server) grpcConnsForJob(cs *grpcConnSet) (*grpcConnSet, func()) {
+	switch {
+	case srv.connectionModel == "job", cs == nil && srv.grpcConns == nil:
+		cs = newGRPCConnSet()
+		return cs, cs.close
+
+	case cs == nil:
+		return srv.grpcConns, func() {}
+	}
+
+	return cs, func() {}
+}
+
+// grpcMethod will find the descriptor of method m of service svc at URL u for step s. The descriptor set of the step
+// takes precedence over the jobs, and without any descriptor set the descriptors are loaded with server reflection over
+// the connection conn, limited by timeout. Descriptors loaded with reflection are cached on the Server. Methods that can't
+// be found are returned as a gRPC status, so that the error policy applies.
+// Returns protoreflect.MethodDescriptor and error.
+func (j *job) grpcMethod(conn *grpc.ClientConn, u *url.URL, s *step, svc string, m string, timeout time.Duration) (protoreflect.MethodDescriptor, error) {
+	files := s.grpcFiles
+	if files == nil {
+		files = j.grpcFiles
+	}
+
+	if files == nil {
+		var err error
+		files, err = j.reflectedFiles(conn, u.Scheme+"://"+u.Host+"/"+svc, svc, timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d, err := files.FindDescriptorByName(protoreflect.FullName(svc))
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "Couldn't find service %s. %s", svc, err.Error())
+	}
+
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "%s is not a service", svc)
+	}
+
+	md := sd.Methods().ByName(protoreflect.Name(m))
+	switch {
+	case md == nil:
+		return nil, status.Errorf(codes.NotFound, "Couldn't find method %s in service %s", m, svc)
+
+	case md.IsStreamingClient() || md.IsStreamingServer():
+		return nil, status.Errorf(codes.Unimplemented, "Method %s is streaming, only unary methods are supported", m)
+	}
+
+	return md, nil
+}
+
+// reflectedFiles will return the file descriptors of service svc loaded with server reflection over the connection conn,
+// limited by timeout. Descriptors are cached on the Server by key so that reflection is only used once per service.
+// Returns *protoregistry.Files and error.
+func (j *job) reflectedFiles(conn *grpc.ClientConn, key string, svc string, timeout time.Duration) (*protoregistry.Files, error) {
+	srv := j.srv
+	if srv != nil {
+		srv.descriptorMu.Lock()
+		files, ok := srv.grpcReflected[key]
+		srv.descriptorMu.Unlock()
+
+		if ok {
+			return files, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	files, err := grpcReflect(ctx, conn, svc)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w %w", err, ctx.Err())
+		}
+		return nil, err
+	}
+
+	if srv != nil {
+		srv.descriptorMu.Lock()
+		if srv.grpcReflected == nil {
+			srv.grpcReflected = make(map[string]*protoregistry.Files)
+		}
+		srv.grpcReflected[key] = files
+		srv.descriptorMu.Unlock()
+	}
+
+	return files, nil
+}
+
+// grpcReflect will load the file descriptors of service svc, and all its dependencies, with server reflection
+// over the connection conn.
+// Returns *protoregistry.Files and error.
+func grpcReflect(ctx context.Context, conn *grpc.ClientConn, svc string) (*protoregistry.Files, error) {
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't use server reflection. %w", err)
+	}
+	defer stream.CloseSend()
+
+	err = stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: svc},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't use server reflection. %w", err)
+	}
+
+	res, err := stream.Recv()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't use server reflection. %w", err)
+	}
+
+	if e := res.GetErrorResponse(); e != nil {
+		return nil, status.Errorf(codes.Code(e.GetErrorCode()), "Server reflection couldn't find %s. %s", svc, e.GetErrorMessage())
+	}
+
+	set := new(descriptorpb.FileDescriptorSet)
+	for _, b := range res.GetFileDescriptorResponse().GetFileDescriptorProto() {
+		fd := new(descriptorpb.FileDescriptorProto)
+		if err := proto.Unmarshal(b, fd); err != nil {
+			return nil, fmt.Errorf("Couldn't unmarshal file descriptor from server reflection. %s", err.Error())
+		}
+		set.File = append(set.File, fd)
+	}
+
+	return protodesc.NewFiles(set)
+}
@@ -0,0 +1,298 @@
+package steptest
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// inventoryDescriptor returns the descriptor of a inventory.proto with a Inventory service with a unary GetStock method.
+func inventoryDescriptor() *descriptorpb.FileDescriptorProto {
+	field := func(name string, number int32, t descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Type:     t.Enum(),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+	}
+
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("inventory.proto"),
+		Package: proto.String("inventory"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("StockRequest"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("sku", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			}},
+			{Name: proto.String("StockReply"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("sku", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("quantity", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+			}},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{
+			{Name: proto.String("Inventory"), Method: []*descriptorpb.MethodDescriptorProto{
+				{Name: proto.String("GetStock"), InputType: proto.String(".inventory.StockRequest"), OutputType: proto.String(".inventory.StockReply")},
+			}},
+		},
+	}
+}
+
+// inventoryServer is a gRPC server with the Inventory service and server reflection.
+// Client is the x-client metadata of the last call, and conns and reflections count the accepted connections
+// and reflection streams.
+type inventoryServer struct {
+	url         string
+	client      string
+	conns       int32
+	reflections int32
+}
+
+// countingListener counts the connections accepted by the Listener in n.
+type countingListener struct {
+	net.Listener
+	n *int32
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(l.n, 1)
+	}
+	return c, err
+}
+
+// newInventoryServer will start a gRPC server with the Inventory service, which answers GetStock with quantity 7
+// and NotFound for the sku missing. It's stopped when the test ends.
+func newInventoryServer(t *testing.T) *inventoryServer {
+	fd, err := protodesc.NewFile(inventoryDescriptor(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := new(protoregistry.Files)
+	files.RegisterFile(fd)
+
+	method := fd.Services().Get(0).Methods().Get(0)
+	is := &inventoryServer{}
+
+	gs := grpc.NewServer(grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, h grpc.StreamHandler) error {
+		if strings.Contains(info.FullMethod, "ServerReflection") {
+			atomic.AddInt32(&is.reflections, 1)
+		}
+		return h(srv, ss)
+	}))
+	gs.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "inventory.Inventory",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "GetStock",
+			Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := dynamicpb.NewMessage(method.Input())
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+
+				if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("x-client")) > 0 {
+					is.client = md.Get("x-client")[0]
+				}
+
+				sku := in.Get(method.Input().Fields().ByName("sku")).String()
+				if sku == "missing" {
+					return nil, status.Error(codes.NotFound, "unknown sku")
+				}
+
+				grpc.SetHeader(ctx, metadata.Pairs("x-warehouse", "north"))
+				out := dynamicpb.NewMessage(method.Output())
+				out.Set(method.Output().Fields().ByName("sku"), protoreflect.ValueOfString(sku))
+				out.Set(method.Output().Fields().ByName("quantity"), protoreflect.ValueOfInt32(7))
+				return out, nil
+			},
+		}},
+	}, struct{}{})
+	reflectionpb.RegisterServerReflectionServer(gs, reflection.NewServerV1(reflection.ServerOptions{Services: gs, DescriptorResolver: files}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gs.Serve(countingListener{Listener: l, n: &is.conns})
+	t.Cleanup(gs.Stop)
+
+	is.url = "grpc://" + l.Addr().String() + "/inventory.Inventory/GetStock"
+	return is
+}
+
+func TestGRPC(t *testing.T) {
+	is := newInventoryServer(t)
+	srv, _ := New(1, 5000, nil)
+
+	steps := "- var { \"name\": \"sku\", \"value\": \"sku-1\" }\n"
+	steps += "- grpc " + is.url + " {\"sku\":\"{{sku}}\"}\n"
+	steps += "  header { \"name\": \"X-Client\", \"value\": \"steptest\" }\n"
+	steps += "  expect { \"type\": \"json\", \"path\": \"quantity\", \"value\": \"7\" }\n"
+	steps += "  expect { \"type\": \"json\", \"path\": \"sku\", \"value\": \"{{sku}}\" }\n"
+	steps += "  varfrom { \"from\": \"header\", \"name\": \"warehouse\", \"find\": \"X-Warehouse\" }\n"
+
+	j, err := srv.parseJob(&rawJob{steps: steps})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	if j.vars["warehouse"] != "north" || is.client != "steptest" {
+		t.Errorf("Expected warehouse north and client steptest but got %s and %s", j.vars["warehouse"], is.client)
+	}
+
+	if res := r.Steps[1]; res.Status != 200 || res.GRPCStatus != "OK" || res.Method != "GRPC" {
+		t.Errorf("Expected status 200 and OK but got %d and %s", res.Status, res.GRPCStatus)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	is := newInventoryServer(t)
+	srv, _ := New(1, 5000, nil)
+
+	set, _ := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{inventoryDescriptor()}})
+	file := filepath.Join(t.TempDir(), "inventory.protoset")
+	if err := os.WriteFile(file, set, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		steps  string
+		err    string
+		status int
+	}{
+		// The gRPC status is mapped to a HTTP status, which fails the step by the default error policy.
+		{"not found", "- @descriptor " + file + "\n- grpc " + is.url + " {\"sku\":\"missing\"}\n", "unknown sku", 404},
+		{"unknown method", "- grpc " + strings.Replace(is.url, "GetStock", "ListStock", 1) + "\n", "Couldn't find method ListStock", 404},
+		{"proxy", "- @proxy http://127.0.0.1:3128\n- grpc " + is.url + "\n", "Proxies aren't supported", -1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			j, err := srv.parseJob(&rawJob{steps: test.steps})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := srv.fetchJob(j, srv.fetchFunc)
+			if r.Err == nil || r.Err.Status != test.status || !strings.Contains(r.Err.Error.Error(), test.err) {
+				t.Errorf("Expected an error containing %q with status %d but got %v", test.err, test.status, r.Err)
+			}
+		})
+	}
+}
+
+func TestGRPCTransportErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	down := "grpc://" + l.Addr().String() + "/inventory.Inventory/GetStock"
+
+	set, _ := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{inventoryDescriptor()}})
+	file := filepath.Join(t.TempDir(), "inventory.protoset")
+	if err := os.WriteFile(file, set, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		steps string
+		err   bool
+		soft  int
+	}{
+		// A refused dial is a transport error, both when reflecting and calling the method.
+		{"reflection", "- grpc " + down + "\n", true, 0},
+		{"call", "- @descriptor " + file + "\n- grpc " + down + "\n", true, 0},
+		{"soft", "- @errors { \"soft\": true }\n- grpc " + down + "\n", false, 1},
+		{"ignored", "- @errors { \"transport\": [\"timeout\"] }\n- grpc " + down + "\n", false, 0},
+		{"ignored call", "- @errors { \"transport\": [\"dns\"] }\n- @descriptor " + file + "\n- grpc " + down + "\n", false, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv, _ := New(1, 5000, nil)
+			j, err := srv.parseJob(&rawJob{steps: test.steps})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := srv.fetchJob(j, srv.fetchFunc)
+			if (r.Err != nil) != test.err || len(r.SoftErrors) != test.soft {
+				t.Fatalf("Expected error %t and %d soft errors but got %v and %d", test.err, test.soft, r.Err, len(r.SoftErrors))
+			}
+
+			if r.Err != nil && (r.Err.Status != -1 || classifyTransportError(r.Err.Error) != "refused") {
+				t.Errorf("Expected a refused transport error with status -1 but got %s with status %d", r.Err.Error, r.Err.Status)
+			}
+		})
+	}
+}
+
+func TestGRPCConnections(t *testing.T) {
+	for _, test := range []struct {
+		model string
+		conns int32
+	}{
+		{"shared", 1},
+		{"job", 3},
+	} {
+		t.Run(test.model, func(t *testing.T) {
+			is := newInventoryServer(t)
+			srv, _ := New(1, 5000, nil)
+			srv.SetConnectionModel(test.model)
+
+			for i := 0; i < 3; i++ {
+				j, err := srv.parseJob(&rawJob{steps: "- grpc " + is.url + " {\"sku\":\"sku-1\"}\n"})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+					t.Fatal(r.Err.Error)
+				}
+			}
+
+			// Reflected descriptors are cached on the Server and reused by the following jobs.
+			if n := atomic.LoadInt32(&is.reflections); n != 1 {
+				t.Errorf("Expected 1 reflection stream but got %d", n)
+			}
+
+			if n := atomic.LoadInt32(&is.conns); n != test.conns {
+				t.Errorf("Expected %d connections but got %d", test.conns, n)
+			}
+		})
+	}
+}
+
+func TestCreateGRPC(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+
+	for _, a := range []string{"grpc http://localhost/inventory.Inventory/GetStock", "grpc grpc://localhost/GetStock", "descriptor missing.protoset"} {
+		if _, err := srv.parseJob(&rawJob{steps: "- " + a + "\n"}); err == nil {
+			t.Errorf("Expected error for invalid %s but got nil", a)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package steptest
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testServer is a httptest.Server that records every request it receives before passing it on to its handler.
+// The server is closed when the test ends.
+type testServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	received []recordedRequest
+}
+
+// recordedRequest is a request received by a testServer and its body.
+type recordedRequest struct {
+	*http.Request
+	body string
+}
+
+// newTestServer will start a testServer with the handler h.
+// Returns *testServer.
+func newTestServer(t *testing.T, h http.HandlerFunc) *testServer {
+	ts := &testServer{}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(b))
+
+		ts.mu.Lock()
+		ts.received = append(ts.received, recordedRequest{Request: r, body: string(b)})
+		ts.mu.Unlock()
+
+		h(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// requests will return the requests received by the testServer ts so far.
+// Returns []recordedRequest.
+func (ts *testServer) requests() []recordedRequest {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return append([]recordedRequest(nil), ts.received...)
+}
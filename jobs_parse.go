@@ -8,7 +8,9 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -25,8 +27,21 @@ const (
 var (
 	// Allowed condition types for the if/condition statement.
 	allowedConditions = []string{"exists", "equals", "greater", "less", "true", "false"}
+
+	// Allowed expectation types for the expect statement.
+	allowedExpectations = []string{"status", "contains", "notcontains", "regexp", "json", "schema", "header", "time"}
+
+	// Allowed sources for the varfrom statement.
+	allowedVarfromSources = []string{"body", "header", "status", "url", "location", "cookie", "time", "json"}
 )
 
+// multiLineStepTypes contains the step types whose arguments continue on the following lines that are indented
+// deeper than the lineSeparator. Deeper indented lines after any other statement are statements of their own.
+var multiLineStepTypes = map[string]bool{
+	"graphql":   true,
+	"variables": true,
+}
+
 // stepTypes contains all the supported functions of the stepsfile.
 // If any row begins with anything else than described below it will result in an error.
 // Variables and cookies are always global. So keep this in mind that there are no scopes.
@@ -34,29 +49,52 @@ var (
 // by adding @ in front of cookie/header.
 // Rows only containing one newline will be ignored.
 var stepTypes = map[string]func(*job, *step, *string) error{
-	"get":     createGet,
-	"post":    createPost,
-	"patch":   createPatch,
-	"put":     createPut,
-	"delete":  createDelete,
-	"var":     createVar,
-	"array":   createArray,
-	"varfrom": createVarFrom,
-	"cookie":  createCookie,
-	"header":  createHeader,
-	"auth":    createAuth,
-	"@header": createGlobalHeader,
-	"@auth":   createGlobalAuth,
-	"for":     startForLoop,
-	"forend":  endForLoop,
-	"if":      createIf,
+	"get":         createGet,
+	"post":        createPost,
+	"patch":       createPatch,
+	"put":         createPut,
+	"delete":      createDelete,
+	"var":         createVar,
+	"array":       createArray,
+	"varfrom":     createVarFrom,
+	"cookie":      createCookie,
+	"header":      createHeader,
+	"auth":        createAuth,
+	"@header":     createGlobalHeader,
+	"@auth":       createGlobalAuth,
+	"for":         startForLoop,
+	"forend":      endForLoop,
+	"if":          createIf,
+	"expect":      createExpect,
+	"errors":      createErrors,
+	"@errors":     createGlobalErrors,
+	"@tls":        createGlobalTLS,
+	"@proxy":      createGlobalProxy,
+	"@profiles":   createGlobalProfiles,
+	"sign":        createSign,
+	"@sign":       createGlobalSign,
+	"compress":    createCompress,
+	"@compress":   createGlobalCompress,
+	"@resolve":    createGlobalResolve,
+	"@network":    createGlobalNetwork,
+	"redirect":    createRedirect,
+	"protocol":    createProtocol,
+	"response":    createResponse,
+	"ws":          createWebSocket,
+	"grpc":        createGRPC,
+	"descriptor":  createDescriptor,
+	"@descriptor": createGlobalDescriptor,
+	"graphql":     createGraphQL,
+	"operation":   createOperation,
+	"variables":   createVariables,
+	"sse":         createSSE,
 }
 
 // parseJob takes raw job r and creates a job out of it.
 // It then parses r.steps and turns it into a parsed job.
 // Returns *job and error.
 func (srv *Server) parseJob(r *rawJob) (*job, error) {
-	j := &job{arrays: make(map[string][]string), vars: r.vars}
+	j := &job{srv: srv, arrays: make(map[string][]string), vars: r.vars}
 
 	if j.vars == nil {
 		j.vars = make(map[string]string)
@@ -66,6 +104,7 @@ func (srv *Server) parseJob(r *rawJob) (*job, error) {
 	if err != nil {
 		return nil, err
 	}
+	j.setProfile()
 
 	return j, nil
 }
@@ -105,6 +144,8 @@ func (j *job) createSteps(r *rawJob) error {
 }
 
 // createStep takes step s and splits it into lines based on the lineSeparator.
+// Lines indented deeper than the lineSeparator following a statement of multiLineStepTypes, such as multi-line
+// GraphQL queries or variables, are continuations of it and are joined with it by newlines.
 // It will iterate over each line and call *job.createStepLine for each line.
 // Returns error.
 func (j *job) createStep(s *string) error {
@@ -115,15 +156,31 @@ func (j *job) createStep(s *string) error {
 	}
 
 	// Remove all newlines and split by lineSeparatorRegexp.
-	r := regexp.Split(*s, -1)
-	for _, row := range r {
+	r := []string{}
+	for _, row := range regexp.Split(*s, -1) {
 		row = strings.Replace(row, newline, "", -1)
+
+		switch {
+		case len(r) > 0 && multiLineStepTypes[stepKeyword(r[len(r)-1])] && strings.IndexAny(row, trim) == 0:
+			r[len(r)-1] += newline + row
+
+		default:
+			r = append(r, row)
+		}
+	}
+
+	for _, row := range r {
 		err := j.createStepLine(stp, &row)
 		if err != nil {
 			return err
 		}
 	}
 
+	err = j.checkHooks(stp)
+	if err != nil {
+		return err
+	}
+
 	// Determine if we should add the step to the job or to a for loop.
 	// If the addTo slice is not empty, the tep should be added to a for loop step.
 	// Otherwise we will hit the default case, which is just to add it as a regular
@@ -147,6 +204,12 @@ func (j *job) createStep(s *string) error {
 	return nil
 }
 
+// stepKeyword will return the lower case keyword of the statement row.
+// Returns string.
+func stepKeyword(row string) string {
+	return strings.ToLower(strings.SplitN(strings.Trim(row, trim), separator, 2)[0])
+}
+
 // addStepToJob will add a step to the global steps slice of the job. So all regular steps
 // will be added by this function.
 func (j *job) addStepToJob(stp *step) {
@@ -165,7 +228,7 @@ func (j *job) addStepToForLoop(stp *step) {
 }
 
 // createStepLine will call the function based on what keyword is defined in the step.
-// See stepTypes for the different types/keywords. Any empty rows will be ignored.
+// See stepTypes for the different types/keywords, and any custom step types registered on the Server. Any empty rows will be ignored.
 // We will trim all leading and empty spaces so that empty rows with a singel space will not cause an error.
 // We will assign the function to f based on the stepTypes map.
 // Returns error.
@@ -178,6 +241,9 @@ func (j *job) createStepLine(step *step, r *string) error {
 	}
 
 	f, ok := stepTypes[t]
+	if !ok {
+		f, ok = j.customStepType(t)
+	}
 	if !ok {
 		return fmt.Errorf("Couldn't find function type %s in stepTypes map in *job.createStepLine", t)
 	}
@@ -228,6 +294,7 @@ func createDelete(j *job, s *step, a *string) error {
 
 // createHTTPStep will take m method and a args and set the correct method, url
 // and body to the step. If method is GET or no body argument is supplied no body will be set.
+// Bodies streamed from @file:, @random: or @repeat: are validated unless they contain variables.
 // Returns error.
 func (s *step) createHTTPStep(m string, a *string) error {
 	v := strings.SplitN(*a, separator, 2)
@@ -240,6 +307,12 @@ func (s *step) createHTTPStep(m string, a *string) error {
 		s.body = v[1]
 	}
 
+	if !strings.Contains(s.body, "{{") {
+		if _, err := parseBodySource(s.body); err != nil {
+			return fmt.Errorf("%s was declared but the body is invalid in *step.createHTTPStep. %s. Raw %s", m, err.Error(), *a)
+		}
+	}
+
 	s.method = m
 	s.url = v[0]
 	return nil
@@ -269,7 +342,8 @@ func createVar(j *job, s *step, a *string) error {
 
 // createVarFrom will add a variable to the jobs j vars map depending on the result from the steps HTTP request.
 // The value can be fetched by specifying either BODY or HEADER and then specifying a pattern to look for in args a.
-// Substitute the value to get from the search syntax with searchSyntax. Step s will be ignored.
+// Substitute the value to get from the search syntax with searchSyntax. STATUS, URL, LOCATION and TIME
+// don't need a pattern, COOKIE takes the name of the cookie to fetch the value from and JSON a path.
 // Returns error.
 func createVarFrom(j *job, s *step, a *string) error {
 	v := new(varfromItem)
@@ -277,6 +351,7 @@ func createVarFrom(j *job, s *step, a *string) error {
 	if err != nil {
 		return fmt.Errorf("varfrom was declared but we couldn't unmarshal it in createVarFrom. Raw %s", *a)
 	}
+	v.From = strings.ToLower(v.From)
 
 	switch {
 	case v.From == "":
@@ -285,13 +360,22 @@ func createVarFrom(j *job, s *step, a *string) error {
 	case v.Varname == "":
 		return fmt.Errorf("varfrom was declared but NAME was not supplied in createVarFrom. Raw %s", *a)
 
-	case v.OrgSyntax == "":
+	case v.OrgSyntax == "" && (v.From == "body" || v.From == "header" || v.From == "cookie" || v.From == "json"):
 		return fmt.Errorf("varfrom was declared but FIND was not supplied in createVarFrom. Raw %s", *a)
+
+	case v.Required && v.Default != "":
+		return fmt.Errorf("varfrom was declared with both REQUIRED and DEFAULT which can't be combined in createVarFrom. Raw %s", *a)
 	}
 
-	v.Syntax = *j.createSearchPattern(&v.OrgSyntax)
-	s.varfrom = append(s.varfrom, *v)
-	return nil
+	for _, f := range allowedVarfromSources {
+		if strings.ToLower(v.From) == f {
+			v.Syntax = *j.createSearchPattern(&v.OrgSyntax)
+			s.varfrom = append(s.varfrom, *v)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("varfrom was declared but the supplied FROM is not supported. Supported sources are %s in createVarFrom. Raw %s", allowedVarfromSources, *a)
 }
 
 // createSearchPattern will take an input pattern p and convert it to a regular expression we can use to parse the BODY/HEADERS of a result.
@@ -353,8 +437,8 @@ func createHeader(j *job, s *step, a *string) error {
 	return nil
 }
 
-// createAuth will add Basic Auth to the step s based on data in args a.
-// Basic Auth added with createAuth will be local to the specified step s only. Jobs j will be ignored.
+// createAuth will add Basic, Bearer, OAuth2 or Digest Auth to the step s based on data in args a.
+// Auth added with createAuth will be local to the specified step s only. Jobs j will be ignored.
 // Returns error.
 func createAuth(j *job, s *step, a *string) error {
 	ba := new(auth)
@@ -363,15 +447,12 @@ func createAuth(j *job, s *step, a *string) error {
 		return fmt.Errorf("auth was declared but we couldn't unmarshal it in createAuth. Raw %s", *a)
 	}
 
-	switch {
-	case ba.Username == "":
-		return fmt.Errorf("auth was declared but USERNAME was not supplied in createAuth. Raw %s", *a)
-
-	case ba.Password == "":
-		return fmt.Errorf("auth was declared but PASSWORD was not supplied in createAuth. Raw %s", *a)
+	err = ba.parse()
+	if err != nil {
+		return fmt.Errorf("auth was declared but %s in createAuth. Raw %s", err.Error(), *a)
 	}
 
-	s.auth.Username, s.auth.Password = ba.Username, ba.Password
+	s.auth = *ba
 	return nil
 }
 
@@ -397,8 +478,8 @@ func createGlobalHeader(j *job, s *step, a *string) error {
 	return nil
 }
 
-// createGlobalAuth will add Basic Auth to the job j based on data in args a.
-// Basic Auth added with createGlobalAuth will be global to all steps in job j. Step s will be ignored.
+// createGlobalAuth will add Basic, Bearer, OAuth2 or Digest Auth to the job j based on data in args a.
+// Auth added with createGlobalAuth will be global to all steps in job j. Step s will be ignored.
 // Returns error.
 func createGlobalAuth(j *job, s *step, a *string) error {
 	ba := new(auth)
@@ -407,15 +488,12 @@ func createGlobalAuth(j *job, s *step, a *string) error {
 		return fmt.Errorf("@auth was declared but we couldn't unmarshal it in createGlobalAuth. Raw %s", *a)
 	}
 
-	switch {
-	case ba.Username == "":
-		return fmt.Errorf("@auth was declared but USERNAME was not supplied in createGlobalAuth. Raw %s", *a)
-
-	case ba.Password == "":
-		return fmt.Errorf("@auth was declared but PASSWORD was not supplied in createGlobalAuth. Raw %s", *a)
+	err = ba.parse()
+	if err != nil {
+		return fmt.Errorf("@auth was declared but %s in createGlobalAuth. Raw %s", err.Error(), *a)
 	}
 
-	j.globalAuth.Username, j.globalAuth.Password = ba.Username, ba.Password
+	j.globalAuth = *ba
 	return nil
 }
 
@@ -528,3 +606,347 @@ func createIf(j *job, s *step, a *string) error {
 
 	return fmt.Errorf("if was declared but the supplied TYPE is not supported. Supported types are %s in createId. Raw %s", allowedConditions, *a)
 }
+
+// createExpect will create an expectation that the response of the step s must meet based on args a.
+// Status, regexp and time expectations will be parsed directly so that any syntax errors are found
+// when the job is parsed. Failed expectations will result in an error for the step.
+// Returns error.
+func createExpect(j *job, s *step, a *string) error {
+	e := new(expectation)
+	err := json.Unmarshal([]byte(*a), e)
+	if err != nil {
+		return fmt.Errorf("expect was declared but we couldn't unmarshal it in createExpect. Raw %s", *a)
+	}
+	e.Type = strings.ToLower(e.Type)
+
+	switch {
+	case e.Type == "":
+		return fmt.Errorf("expect was declared but TYPE was not supplied in createExpect. Raw %s", *a)
+
+	case e.Value == "" && e.Type != "json" && e.Type != "header":
+		return fmt.Errorf("expect was declared but VALUE was not supplied in createExpect. Raw %s", *a)
+
+	case e.Path == "" && e.Type == "json":
+		return fmt.Errorf("expect was declared but PATH was not supplied in createExpect. Raw %s", *a)
+
+	case e.Name == "" && e.Type == "header":
+		return fmt.Errorf("expect was declared but NAME was not supplied in createExpect. Raw %s", *a)
+	}
+
+	switch e.Type {
+	case "status":
+		e.statuses, err = parseStatusRanges(e.Value)
+		if err != nil {
+			return fmt.Errorf("expect was declared but VALUE is not a valid status in createExpect. %s. Raw %s", err.Error(), *a)
+		}
+
+	case "regexp":
+		e.regexp, err = regexp.Compile(e.Value)
+		if err != nil {
+			return fmt.Errorf("expect was declared but VALUE is not a valid regular expression in createExpect. %s. Raw %s", err.Error(), *a)
+		}
+
+	case "time":
+		ms, err := strconv.Atoi(e.Value)
+		if err != nil {
+			return fmt.Errorf("expect was declared but VALUE is not a valid number of milliseconds in createExpect. Raw %s", *a)
+		}
+		e.maxTime = time.Duration(ms) * time.Millisecond
+
+	case "schema":
+		e.schema, err = j.loadSchema(e.Value)
+		if err != nil {
+			return fmt.Errorf("expect was declared but the schema couldn't be loaded in createExpect. %s. Raw %s", err.Error(), *a)
+		}
+	}
+
+	for _, t := range allowedExpectations {
+		if e.Type == t {
+			s.expect = append(s.expect, *e)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("expect was declared but the supplied TYPE is not supported. Supported types are %s in createExpect. Raw %s", allowedExpectations, *a)
+}
+
+// loadSchema will load the JSON Schema from file f. Schemas are cached on the job j
+// so that each schema file is only loaded once per job.
+// Returns *jsonSchema and error.
+func (j *job) loadSchema(f string) (*jsonSchema, error) {
+	if j.schemas == nil {
+		j.schemas = make(map[string]*jsonSchema)
+	}
+
+	if js, ok := j.schemas[f]; ok {
+		return js, nil
+	}
+
+	js, err := loadJSONSchema(f)
+	if err != nil {
+		return nil, err
+	}
+
+	j.schemas[f] = js
+	return js, nil
+}
+
+// createErrors will set which responses and transport errors that count as failures for the step s based on args a.
+// Errors added with createErrors will be local to the specified step s only. Jobs j will be ignored.
+// Returns error.
+func createErrors(j *job, s *step, a *string) error {
+	e := new(errorPolicy)
+	err := json.Unmarshal([]byte(*a), e)
+	if err != nil {
+		return fmt.Errorf("errors was declared but we couldn't unmarshal it in createErrors. Raw %s", *a)
+	}
+
+	err = e.parse()
+	if err != nil {
+		return fmt.Errorf("errors was declared but is invalid in createErrors. %s. Raw %s", err.Error(), *a)
+	}
+
+	s.errorPolicy = *e
+	return nil
+}
+
+// createGlobalErrors will set which responses and transport errors that count as failures for the job j based on args a.
+// Errors added with createGlobalErrors will be global to all steps in job j. Step s will be ignored.
+// Returns error.
+func createGlobalErrors(j *job, s *step, a *string) error {
+	e := new(errorPolicy)
+	err := json.Unmarshal([]byte(*a), e)
+	if err != nil {
+		return fmt.Errorf("@errors was declared but we couldn't unmarshal it in createGlobalErrors. Raw %s", *a)
+	}
+
+	err = e.parse()
+	if err != nil {
+		return fmt.Errorf("@errors was declared but is invalid in createGlobalErrors. %s. Raw %s", err.Error(), *a)
+	}
+
+	j.globalErrorPolicy = *e
+	return nil
+}
+
+// createRedirect will set how redirects should be handled for the step s based on args a.
+// Redirect policies added with createRedirect will be local to the specified step s only. Jobs j will be ignored.
+// Returns error.
+func createRedirect(j *job, s *step, a *string) error {
+	r := new(redirectPolicy)
+	err := json.Unmarshal([]byte(*a), r)
+	if err != nil {
+		return fmt.Errorf("redirect was declared but we couldn't unmarshal it in createRedirect. Raw %s", *a)
+	}
+	r.Mode = strings.ToLower(r.Mode)
+
+	if r.Mode == "" {
+		return fmt.Errorf("redirect was declared but MODE was not supplied in createRedirect. Raw %s", *a)
+	}
+
+	err = r.parse()
+	if err != nil {
+		return fmt.Errorf("redirect was declared but is invalid in createRedirect. %s. Raw %s", err.Error(), *a)
+	}
+
+	s.redirectPolicy = *r
+	return nil
+}
+
+// createResponse will set how the body of the response should be read for step s based on args a.
+// Returns error.
+func createResponse(j *job, s *step, a *string) error {
+	r := new(responseMode)
+	err := json.Unmarshal([]byte(*a), r)
+	if err != nil {
+		return fmt.Errorf("response was declared but we couldn't unmarshal it in createResponse. Raw %s", *a)
+	}
+
+	if r.Mode == "" {
+		return fmt.Errorf("response was declared but MODE was not supplied in createResponse. Raw %s", *a)
+	}
+
+	err = r.parse()
+	if err != nil {
+		return fmt.Errorf("response was declared but is invalid in createResponse. %s. Raw %s", err.Error(), *a)
+	}
+
+	s.responseMode = *r
+	return nil
+}
+
+// createProtocol will set the protocol of the built-in client for the step s based on args a.
+// The protocol will be local to the specified step s only. Jobs j will be ignored.
+// Returns error.
+func createProtocol(j *job, s *step, a *string) error {
+	p := strings.ToLower(strings.Trim(*a, trim))
+
+	for _, protocol := range allowedProtocols {
+		if p == protocol {
+			s.protocol = p
+			return nil
+		}
+	}
+
+	return fmt.Errorf("protocol was declared but the supplied protocol is not supported. Supported protocols are %s in createProtocol. Raw %s", allowedProtocols, *a)
+}
+
+// createGlobalTLS will set the TLS options for the job j based on args a. Any option that isn't set
+// will use the value of the Servers TLS options.
+// TLS options added with createGlobalTLS will be global for the whole job j. Step s will be ignored.
+// Returns error.
+func createGlobalTLS(j *job, s *step, a *string) error {
+	o := new(TLSOptions)
+	err := json.Unmarshal([]byte(*a), o)
+	if err != nil {
+		return fmt.Errorf("@tls was declared but we couldn't unmarshal it in createGlobalTLS. Raw %s", *a)
+	}
+
+	switch {
+	case j.srv != nil:
+		merged := j.srv.tlsOptions.merge(o)
+		j.tls, err = j.srv.loadTLSConfig(&merged)
+
+	default:
+		j.tls, err = o.tlsConfig()
+	}
+
+	if err != nil {
+		return fmt.Errorf("@tls was declared but is invalid in createGlobalTLS. %s. Raw %s", err.Error(), *a)
+	}
+
+	return nil
+}
+
+// createGlobalProxy will set the proxy for the job j based on args a.
+// The proxy added with createGlobalProxy will be global for the whole job j. Step s will be ignored.
+// Returns error.
+func createGlobalProxy(j *job, s *step, a *string) error {
+	proxy, err := parseProxy(strings.Trim(*a, trim))
+	if err != nil {
+		return fmt.Errorf("@proxy was declared but is invalid in createGlobalProxy. %s. Raw %s", err.Error(), *a)
+	}
+
+	j.proxyURL = proxy
+	return nil
+}
+
+// createGlobalProfiles will set the weighted pool of browser profiles for the job j based on args a.
+// The profile of the job is picked from the pool when the job has been parsed.
+// Profiles added with createGlobalProfiles will be global for the whole job j. Step s will be ignored.
+// Returns error.
+func createGlobalProfiles(j *job, s *step, a *string) error {
+	p := make(map[string]int)
+	err := json.Unmarshal([]byte(*a), &p)
+	if err != nil {
+		return fmt.Errorf("@profiles was declared but we couldn't unmarshal it in createGlobalProfiles. Raw %s", *a)
+	}
+
+	err = parseProfiles(p)
+	if err != nil {
+		return fmt.Errorf("@profiles was declared but is invalid in createGlobalProfiles. %s. Raw %s", err.Error(), *a)
+	}
+
+	j.profiles = p
+	return nil
+}
+
+// createSign will set how the request of step s should be signed based on args a.
+// Signing added with createSign will be local to the specified step s only. Jobs j will be ignored.
+// Returns error.
+func createSign(j *job, s *step, a *string) error {
+	g := new(signing)
+	err := json.Unmarshal([]byte(*a), g)
+	if err != nil {
+		return fmt.Errorf("sign was declared but we couldn't unmarshal it in createSign. Raw %s", *a)
+	}
+
+	err = g.parse()
+	if err != nil {
+		return fmt.Errorf("sign was declared but %s in createSign. Raw %s", err.Error(), *a)
+	}
+
+	s.signing = *g
+	return nil
+}
+
+// createGlobalSign will set how the requests of the job j should be signed based on args a.
+// Signing added with createGlobalSign will be global to all steps in job j. Step s will be ignored.
+// Returns error.
+func createGlobalSign(j *job, s *step, a *string) error {
+	g := new(signing)
+	err := json.Unmarshal([]byte(*a), g)
+	if err != nil {
+		return fmt.Errorf("@sign was declared but we couldn't unmarshal it in createGlobalSign. Raw %s", *a)
+	}
+
+	err = g.parse()
+	if err != nil {
+		return fmt.Errorf("@sign was declared but %s in createGlobalSign. Raw %s", err.Error(), *a)
+	}
+
+	j.globalSigning = *g
+	return nil
+}
+
+// createCompress will set the compression of the request body of step s based on args a.
+// The compression will be local to the specified step s only. Jobs j will be ignored.
+// Returns error.
+func createCompress(j *job, s *step, a *string) error {
+	c, err := parseCompression(*a)
+	if err != nil {
+		return fmt.Errorf("compress was declared but is invalid in createCompress. %s. Raw %s", err.Error(), *a)
+	}
+
+	s.compression = c
+	return nil
+}
+
+// createGlobalCompress will set the compression of the request bodies of the job j based on args a.
+// The compression will be global to all steps in job j. Step s will be ignored.
+// Returns error.
+func createGlobalCompress(j *job, s *step, a *string) error {
+	c, err := parseCompression(*a)
+	if err != nil {
+		return fmt.Errorf("@compress was declared but is invalid in createGlobalCompress. %s. Raw %s", err.Error(), *a)
+	}
+
+	j.globalCompression = c
+	return nil
+}
+
+// createGlobalResolve will add a DNS override for the job j based on args a, written as host:port=ip.
+// DNS overrides added with createGlobalResolve will be global to all steps in job j. Step s will be ignored.
+// Returns error.
+func createGlobalResolve(j *job, s *step, a *string) error {
+	parts := strings.SplitN(strings.Trim(*a, trim), "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("@resolve was declared but isn't written as host:port=ip in createGlobalResolve. Raw %s", *a)
+	}
+
+	h := strings.ToLower(strings.Trim(parts[0], trim))
+	addr, err := parseResolve(h, strings.Trim(parts[1], trim))
+	if err != nil {
+		return fmt.Errorf("@resolve was declared but is invalid in createGlobalResolve. %s. Raw %s", err.Error(), *a)
+	}
+
+	if j.resolve == nil {
+		j.resolve = make(map[string]string)
+	}
+	j.resolve[h] = addr
+	return nil
+}
+
+// createGlobalNetwork will set the network shape for the job j based on args a, which is either the name of a preset,
+// profile or a JSON object with download, upload and latency.
+// The network shape will be global to all steps in job j. Step s will be ignored.
+// Returns error.
+func createGlobalNetwork(j *job, s *step, a *string) error {
+	shape, err := parseNetwork(*a)
+	if err != nil {
+		return fmt.Errorf("@network was declared but is invalid in createGlobalNetwork. %s. Raw %s", err.Error(), *a)
+	}
+
+	j.networkShape = shape
+	return nil
+}
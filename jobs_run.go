@@ -2,10 +2,12 @@
 package steptest
 
 import (
-	"bytes"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptrace"
 	"time"
 )
 
@@ -18,13 +20,26 @@ func (srv *Server) workerFetch() {
 	srv.wgRes.Add(1)
 	results := []*Result{}
 
+	c, done := srv.fetchFuncForWorker()
+	defer done()
+
+	grpcConns, doneGRPC := srv.grpcConnsForWorker()
+	defer doneGRPC()
+
+	// OAuth2 tokens and network bandwidth per virtual user.
+	tokens := newTokenCache()
+	shapes := make(map[networkShape]*bandwidth)
+
 	for srv.running {
 		j := <-srv.parsedJobs
 		if j == nil {
 			break
 		}
 
-		res := srv.fetchJob(j)
+		j.workerTokens = tokens
+		j.grpcConns = grpcConns
+		j.workerBandwidth = shapes
+		res := srv.fetchJob(j, c)
 		results = append(results, res)
 		srv.resultCounterChan <- 1
 		srv.wgRun.Done()
@@ -34,10 +49,19 @@ func (srv *Server) workerFetch() {
 }
 
 // fetchJob will loop through the job j steps and call *job.fetchStep through the *job.runFetchJob on each iteration.
+// The requests will be made with the fetch function c, unless the job should use its own connections.
 // Any errors will be added to the results error value.
 // Returns *result.
-func (srv *Server) fetchJob(j *job) *Result {
-	r := &Result{StartTime: time.Now()}
+func (srv *Server) fetchJob(j *job, c func(*http.Request) (*http.Response, error)) *Result {
+	r := &Result{StartTime: time.Now(), Profile: j.profile}
+
+	c, done := srv.fetchFuncForJob(c)
+	defer done()
+	defer j.closeWebSocket()
+
+	var doneGRPC func()
+	j.grpcConns, doneGRPC = srv.grpcConnsForJob(j.grpcConns)
+	defer doneGRPC()
 
 	for i := 0; i < len(j.steps); i++ {
 		switch {
@@ -56,27 +80,26 @@ func (srv *Server) fetchJob(j *job) *Result {
 				j.vars[j.steps[i].forloop.varname] = j.steps[i].forloop.values[v]
 
 				for s := range j.steps[i].forloop.steps {
-					res, err := j.runFetchJob(srv.fetchFunc, j.steps[i].forloop.steps[s].deepCopyStep())
+					res, err := j.runFetchJob(c, j.steps[i].forloop.steps[s].deepCopyStep())
 					r.Steps = append(r.Steps, res)
 					r.Status = res.Status
 
-					if err != nil {
-						r.Err = err
+					if r.addError(err) {
 						break
 					}
 				}
+
+				if r.Err != nil {
+					break
+				}
 			}
 
 		// The default fetching method, when we just have normal global steps (ie, not in a for loop).
 		default:
-			res, err := j.runFetchJob(srv.fetchFunc, &j.steps[i])
+			res, err := j.runFetchJob(c, &j.steps[i])
 			r.Steps = append(r.Steps, res)
 			r.Status = res.Status
-
-			if err != nil {
-				r.Err = err
-				break
-			}
+			r.addError(err)
 		}
 
 		// If any errors where set above, we should not do any more steps.
@@ -91,6 +114,23 @@ func (srv *Server) fetchJob(j *job) *Result {
 	return r
 }
 
+// addError will add the error err to the result r. Soft errors will be added to the soft errors
+// and any other error will be set as the results error.
+// Returns true if the job should stop.
+func (r *Result) addError(err *ResultError) bool {
+	switch {
+	case err == nil:
+		return false
+
+	case err.Soft:
+		r.SoftErrors = append(r.SoftErrors, err)
+		return false
+	}
+
+	r.Err = err
+	return true
+}
+
 // deepCopyStep is used to make a deep copy of a step. Which means that we will copy every array/map it contains
 // so that every step can be run independently of another. Otherwise changes to one step on data structures that
 // are referenced by memory, such as slices, maps will be updated when we replace vars and such. Which is not
@@ -104,6 +144,17 @@ func (s *step) deepCopyStep() *step {
 		auth:    s.auth,
 		url:     s.url,
 		body:    s.body,
+
+		errorPolicy:    s.errorPolicy,
+		redirectPolicy: s.redirectPolicy,
+		responseMode:   s.responseMode,
+		protocol:       s.protocol,
+		signing:        s.signing,
+		compression:    s.compression,
+		ws:             s.ws,
+		grpcFiles:      s.grpcFiles,
+		graphql:        s.graphql,
+		sse:            s.sse,
 	}
 
 	// Make copy of conditions/if slice.
@@ -111,6 +162,11 @@ func (s *step) deepCopyStep() *step {
 		newStep.conditions = append(newStep.conditions, i)
 	}
 
+	// Make copy of expect slice.
+	for _, e := range s.expect {
+		newStep.expect = append(newStep.expect, e)
+	}
+
 	// Make copy of varfrom slice.
 	for _, v := range s.varfrom {
 		newStep.varfrom = append(newStep.varfrom, v)
@@ -126,6 +182,14 @@ func (s *step) deepCopyStep() *step {
 		newStep.cookies = append(newStep.cookies, c)
 	}
 
+	// Make copy of hooks.
+	for _, h := range s.beforeRequest {
+		newStep.beforeRequest = append(newStep.beforeRequest, h)
+	}
+	for _, h := range s.afterResponse {
+		newStep.afterResponse = append(newStep.afterResponse, h)
+	}
+
 	return newStep
 }
 
@@ -135,13 +199,27 @@ func (s *step) deepCopyStep() *step {
 // (multiple steps within a step) or just a basic single step.
 // Returns *ResultSteps and *ResultError.
 func (j *job) runFetchJob(c func(*http.Request) (*http.Response, error), s *step) (*ResultStep, *ResultError) {
-	// Dont run fetch on steps with no URL.
-	if s.url == "" {
+	// Dont run fetch on steps with no URL, except for ws steps using the open WebSocket connection.
+	if s.url == "" && s.ws == nil {
 		return &ResultStep{}, nil
 	}
 
 	stepStart := time.Now()
-	status, err := j.fetchStep(c, s)
+	var status int
+	var err *ResultError
+	switch {
+	case s.ws != nil:
+		status, err = j.webSocketStep(c, s)
+
+	case s.method == "GRPC":
+		status, err = j.grpcStep(c, s)
+
+	case s.sse != nil:
+		status, err = j.sseStep(c, s)
+
+	default:
+		status, err = j.fetchStep(c, s)
+	}
 
 	res := &ResultStep{
 		Method:    s.method,
@@ -152,10 +230,30 @@ func (j *job) runFetchJob(c func(*http.Request) (*http.Response, error), s *step
 		StartTime: stepStart,
 		Duration:  time.Now().Sub(stepStart),
 		Status:    status,
+
+		FinalURL:   s.finalURL,
+		Redirects:  s.redirects,
+		Protocol:   s.responseProtocol,
+		TLSVersion: s.tlsVersion,
+		TLSCipher:  s.tlsCipher,
+
+		BytesSent:       s.bytesSent,
+		BytesReceived:   s.bytesReceived,
+		BytesDecoded:    s.bytesDecoded,
+		ContentEncoding: s.contentEncoding,
+		BodyTruncated:   s.bodyTruncated,
+
+		Timing:           s.timing,
+		ExtractionMisses: s.varfromMisses,
+		WebSocket:        s.wsResult,
+		GRPCStatus:       s.grpcStatus,
+		SSE:              s.sseResult,
 	}
 
 	if err != nil {
+		policy := j.errorPolicy(s)
 		err.Step = res
+		err.Soft = policy.isSoft()
 		return res, err
 	}
 
@@ -168,7 +266,10 @@ func (j *job) runFetchJob(c func(*http.Request) (*http.Response, error), s *step
 // Auth, Headers and Cookies are then added to the request addMetaData function.
 // Will return the statusCode of the request as well as any error. The error will include the
 // step which failed including all the data so it can be easily tracked in logfiles.
-// Any response status code 400 or above will result in an error.
+// Which status codes, transport errors and bodies that results in an error is decided by the error policy
+// of the step, job and Server. By default any status code 400 or above and all transport errors are errors.
+// A status expectation on the step replaces the status code check.
+// The request is traced from being sent until the body was read and the timing is stored in s.timing.
 // Returns int and *ResultError.
 func (j *job) fetchStep(c func(*http.Request) (*http.Response, error), s *step) (int, *ResultError) {
 	if !j.checkConditions(s) {
@@ -176,32 +277,155 @@ func (j *job) fetchStep(c func(*http.Request) (*http.Response, error), s *step)
 	}
 
 	j.replaceFromVariables(s)
+	policy := j.errorPolicy(s)
+	mode := j.responseMode(s)
+
+	// A truncated, empty or filtered body can't be decoded as JSON.
+	if s.needsJSON() {
+		mode = responseMode{Mode: "full"}
+	}
+
+	compression := j.compression(s)
+	body, err := j.requestBody(s, compression)
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("Couldn't create the Body in *job.fetchStep. %s", err.Error()), URL: s.url, Status: -1}
+	}
 
-	req, err := http.NewRequest(s.method, s.url, bytes.NewBuffer([]byte(s.body)))
+	req, err := http.NewRequest(s.method, s.url, nil)
 	if err != nil {
 		return -1, &ResultError{Error: fmt.Errorf("Error creating up the Request in *job.fetchStep. %s", err)}
 	}
+	if body.length != 0 {
+		req.Body, err = body.reader()
+		if err != nil {
+			return -1, &ResultError{Error: fmt.Errorf("Couldn't open the Body in *job.fetchStep. %s", err.Error()), URL: s.url, Status: -1}
+		}
+		req.GetBody = body.reader
+		req.ContentLength = body.length
+	}
+	if compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if s.graphql != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	err = j.addAuth(c, s, req)
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("Couldn't add auth to the Request in *job.fetchStep. %s", err.Error()), URL: s.url, Status: -1}
+	}
 	j.addOptions(s, req)
 
+	err = j.runHooks(s.beforeRequest, &StepContext{Request: req, j: j})
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("BeforeRequest hook failed in *job.fetchStep. %s", err.Error()), URL: s.url, Status: -1}
+	}
+
+	err = j.signRequest(s, req, body)
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("Couldn't sign the Request in *job.fetchStep. %s", err.Error()), URL: s.url, Status: -1}
+	}
+	req, _ = j.withRequestContext(s, req)
+
+	timer := newStepTimer()
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), timer.trace()))
 	res, err := c(req)
+
+	// Retry once with new credentials if the server asked for them. The body of the 401 is counted as received.
+	var unauthorized int64
+	if err == nil && res.StatusCode == http.StatusUnauthorized {
+		retry, authErr := j.retryAuth(c, s, req, res)
+		switch {
+		case authErr != nil:
+			unauthorized, _ = io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+			s.timing = timer.done()
+			s.bytesSent, s.bytesReceived = body.bytesSent(), unauthorized
+			return -1, &ResultError{Error: fmt.Errorf("Couldn't add auth to the Request in *job.fetchStep. %s", authErr.Error()), URL: s.url, Status: -1}
+
+		case retry != nil:
+			unauthorized, _ = io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+			res, err = c(retry)
+		}
+	}
+
+	fetchDuration := time.Now().Sub(timer.start)
 	if err != nil {
-		return -1, &ResultError{Error: fmt.Errorf("Error sending the Request in *job.fetchStep. %s", err)}
+		s.timing = timer.done()
+		s.bytesSent, s.bytesReceived = body.bytesSent(), unauthorized
+		if !policy.isTransportError(err) {
+			return -1, nil
+		}
+		return -1, &ResultError{Error: fmt.Errorf("Error sending the Request in *job.fetchStep. %s", err), URL: s.url, Status: -1}
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode > 399 {
-		body, err := ioutil.ReadAll(res.Body)
+	// Count the bytes of the body both as received and after it has been decoded.
+	wire := &countingBody{ReadCloser: res.Body}
+	res.Body = wire
+	decodeErr := decodeBody(res)
+	decoded := &countingBody{ReadCloser: res.Body}
+	res.Body = decoded
+
+	// Always read the whole body so that the content download can be timed, the transfer size
+	// counted and the connection reused.
+	defer func() {
+		io.Copy(ioutil.Discard, res.Body)
+		s.timing = timer.done()
+		s.bytesSent, s.bytesReceived, s.bytesDecoded = body.bytesSent(), unauthorized+wire.n, decoded.n
+	}()
+
+	s.contentEncoding = res.Header.Get("Content-Encoding")
+	if err := decodeErr; err != nil {
+		return res.StatusCode, &ResultError{Error: fmt.Errorf("Couldn't read Body of response in *job.fetchStep. %s", err.Error()), URL: s.url, Status: res.StatusCode}
+	}
+
+	s.finalURL = responseURL(s, res)
+	s.responseProtocol = res.Proto
+	if res.TLS != nil {
+		s.tlsVersion = tls.VersionName(res.TLS.Version)
+		s.tlsCipher = tls.CipherSuiteName(res.TLS.CipherSuite)
+	}
+
+	if !s.expectsStatus() && policy.isErrorStatus(res.StatusCode) {
+		body := j.readErrorBody(res.Body, mode)
+		return res.StatusCode, &ResultError{Error: fmt.Errorf("%d %s %s", res.StatusCode, s.method, s.url), URL: s.url, Status: res.StatusCode, Body: string(body)}
+	}
+
+	j.storeResponseCookies(res)
+
+	raw := []byte{}
+	if s.needsBody() || policy.body != nil {
+		raw, s.bodyTruncated, err = j.readBody(s, res.Body, mode, policy)
 		if err != nil {
-			body = []byte("")
+			return res.StatusCode, &ResultError{Error: fmt.Errorf("Couldn't read Body of response in *job.fetchStep. %s", err.Error()), URL: s.url, Status: res.StatusCode}
 		}
-		return res.StatusCode, &ResultError{Error: fmt.Errorf("%d %s %s", res.StatusCode, s.method, s.url), URL: s.url, Status: res.StatusCode, Body: string(body)}
 	}
 
-	j.appendResponseCookiesToJob(res)
+	if policy.body != nil && policy.body.Match(raw) {
+		return res.StatusCode, &ResultError{Error: fmt.Errorf("%d %s %s body matches %s", res.StatusCode, s.method, s.url, policy.Body), URL: s.url, Status: res.StatusCode, Body: bodyExcerpt(raw)}
+	}
+
+	if s.graphql != nil {
+		if resErr := j.graphQLError(s, res, raw); resErr != nil {
+			return res.StatusCode, resErr
+		}
+	}
+
+	resErr := j.checkExpectations(s, res, &raw, fetchDuration)
+	if resErr != nil {
+		return res.StatusCode, resErr
+	}
+
+	resErr = j.variablesFrom(s, res, &raw, fetchDuration)
+	if resErr != nil {
+		return res.StatusCode, resErr
+	}
 
-	err = j.variablesFrom(s, res)
+	err = j.runHooks(s.afterResponse, &StepContext{Request: res.Request, Response: res, Body: raw, j: j})
 	if err != nil {
-		return -1, &ResultError{Error: err}
+		return res.StatusCode, &ResultError{Error: fmt.Errorf("AfterResponse hook failed in *job.fetchStep. %s", err.Error()), URL: s.url, Status: res.StatusCode, Body: bodyExcerpt(raw)}
 	}
 
 	return res.StatusCode, nil
@@ -0,0 +1,90 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// jsonSchema contains a compiled JSON Schema that can be used by multiple steps without any further setup.
+// Schemas without $schema are validated as draft-07, and $ref's to other files are resolved relative to the schema file.
+// Recursive $ref's that would never end are reported as an error instead of being followed.
+type jsonSchema struct {
+	schema *jsonschema.Schema
+}
+
+// loadJSONSchema will read and compile the JSON Schema from file f.
+// Returns *jsonSchema and error.
+func loadJSONSchema(f string) (*jsonSchema, error) {
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft7
+
+	schema, err := c.Compile(f)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't compile JSON Schema file %s in loadJSONSchema. %s", f, err.Error())
+	}
+
+	return &jsonSchema{schema: schema}, nil
+}
+
+// decodeJSON will decode the JSON document raw keeping numbers as json.Number.
+// Returns interface{} and error.
+func decodeJSON(raw []byte) (interface{}, error) {
+	doc := new(interface{})
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	err := decoder.Decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	return *doc, nil
+}
+
+// validate will validate the JSON document raw against the schema.
+// Every violation will be returned prefixed with the JSON pointer of the violating value, sorted by the pointer.
+// Returns []string.
+func (js *jsonSchema) validate(raw []byte) []string {
+	doc, err := decodeJSON(raw)
+	if err != nil {
+		return []string{fmt.Sprintf("body isn't valid JSON (%s)", err.Error())}
+	}
+
+	err = js.schema.Validate(doc)
+	if err == nil {
+		return nil
+	}
+
+	ve, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return []string{violation("", err.Error())}
+	}
+
+	violations := []string{}
+	var leaves func(*jsonschema.ValidationError)
+	leaves = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			violations = append(violations, violation(e.InstanceLocation, e.Message))
+		}
+		for _, cause := range e.Causes {
+			leaves(cause)
+		}
+	}
+	leaves(ve)
+
+	sort.Strings(violations)
+	return violations
+}
+
+// violation will return the message m for the violating value at JSON pointer p.
+// Returns string.
+func violation(p string, m string) string {
+	if p == "" {
+		p = "/"
+	}
+	return fmt.Sprintf("schema violation at %s: %s", p, m)
+}
@@ -0,0 +1,110 @@
+package steptest
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONSchemaValidate(t *testing.T) {
+	js, err := loadJSONSchema("testdata/cart_schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := js.validate([]byte(`{"id":"c1","items":[{"sku":"p1","qty":2}],"currency":"SEK"}`))
+	if len(errs) != 0 {
+		t.Errorf("Expected no violations but got %v", errs)
+	}
+
+	errs = js.validate([]byte(`{"id":"x1","items":[{"sku":"","qty":"2"},{"qty":0}],"currency":"USD","total":10}`))
+	expected := []string{"/", "/currency", "/id", "/items/0/qty", "/items/0/sku", "/items/1/qty", "/items/1"}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d violations but got %d. %v", len(expected), len(errs), errs)
+	}
+
+	for i := range expected {
+		if !strings.HasPrefix(errs[i], "schema violation at "+expected[i]+": ") {
+			t.Errorf("Expected violation at %s but got %s", expected[i], errs[i])
+		}
+	}
+}
+
+func TestJSONSchemaRecursive(t *testing.T) {
+	dir := t.TempDir()
+	tree := filepath.Join(dir, "tree.json")
+	loop := filepath.Join(dir, "loop.json")
+	os.WriteFile(tree, []byte(`{"type":"object","required":["name"],"properties":{"children":{"type":"array","items":{"$ref":"#"}}}}`), 0600)
+	os.WriteFile(loop, []byte(`{"$ref":"#"}`), 0600)
+
+	js, err := loadJSONSchema(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := js.validate([]byte(`{"name":"a","children":[{"name":"b","children":[{}]}]}`))
+	if len(errs) != 1 || !strings.HasPrefix(errs[0], "schema violation at /children/0/children/0: ") {
+		t.Errorf("Expected a violation at /children/0/children/0 but got %v", errs)
+	}
+
+	// A $ref that only refers to itself would never end.
+	if _, err := loadJSONSchema(loop); err == nil || !strings.Contains(err.Error(), "infinite loop") {
+		t.Errorf("Expected an infinite loop error but got %v", err)
+	}
+}
+
+func TestLoadSchemaOncePerJob(t *testing.T) {
+	j := &job{vars: make(map[string]string)}
+	s := &step{}
+
+	raw := `{ "type": "schema", "value": "testdata/cart_schema.json" }`
+	for i := 0; i < 2; i++ {
+		if err := createExpect(j, s, &raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.expect[0].schema != s.expect[1].schema {
+		t.Errorf("Expected the schema to only be loaded once per job")
+	}
+
+	missing := `{ "type": "schema", "value": "testdata/missing.json" }`
+	if err := createExpect(j, s, &missing); err == nil {
+		t.Errorf("Expected error for missing schema file but got nil")
+	}
+}
+
+func TestJSONSchemaExpect(t *testing.T) {
+	ts := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/invalid" {
+			w.Write([]byte(`{"id":"c1","items":[{"sku":"p1","qty":2}],"currency":"USD"}`))
+			return
+		}
+		w.Write([]byte(`{"id":"c1","items":[{"sku":"p1","qty":2}],"currency":"SEK"}`))
+	})
+
+	srv, _ := New(1, 5000, nil)
+	expect := "  expect { \"type\": \"schema\", \"value\": \"testdata/cart_schema.json\" }\n"
+
+	j, err := srv.parseJob(&rawJob{steps: "- get " + ts.URL + "/valid\n" + expect + "- get " + ts.URL + "/invalid\n" + expect})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err == nil || r.Err.URL != ts.URL+"/invalid" {
+		t.Fatalf("Expected the invalid response to fail the schema expectation but got %v", r.Err)
+	}
+
+	if len(r.Err.Expectations) != 1 || !strings.Contains(r.Err.Expectations[0], "schema violation at /currency") {
+		t.Errorf("Expected a violation at /currency but got %v", r.Err.Expectations)
+	}
+
+	if n := len(ts.requests()); n != 2 {
+		t.Errorf("Expected %d requests but got %d", 2, n)
+	}
+}
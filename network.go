@@ -0,0 +1,378 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	shapeInterval = 50 * time.Millisecond // shapeInterval is the max amount of data, in time, that is read or written at once by a shaped connection.
+	minShapeChunk = 512                   // minShapeChunk is the min number of bytes that is read or written at once by a shaped connection.
+)
+
+var (
+	// Built-in network presets for the @network statement and *Server.SetNetwork.
+	// Download and upload are in bytes per second, and latency is added per round trip.
+	networkPresets = map[string]networkShape{
+		"2g":   {Download: 250000 / 8, Upload: 50000 / 8, Latency: 300},
+		"3g":   {Download: 750000 / 8, Upload: 250000 / 8, Latency: 100},
+		"4g":   {Download: 4000000 / 8, Upload: 3000000 / 8, Latency: 20},
+		"dsl":  {Download: 2000000 / 8, Upload: 1000000 / 8, Latency: 5},
+		"wifi": {Download: 30000000 / 8, Upload: 15000000 / 8, Latency: 2},
+		"none": {},
+	}
+)
+
+// networkShape contains the bandwidth and latency a connection is shaped to. Download and upload are in bytes
+// per second and latency in milliseconds is added per round trip. Zero means no limit.
+// If profile is true the network preset of the jobs browser profile is used instead.
+type networkShape struct {
+	Download int64 `json:"download"`
+	Upload   int64 `json:"upload"`
+	Latency  int64 `json:"latency"`
+
+	profile bool
+}
+
+// shaped will return true if the network shape n limits the bandwidth or adds latency.
+// Returns bool.
+func (n networkShape) shaped() bool {
+	return n.Download > 0 || n.Upload > 0 || n.Latency > 0
+}
+
+// parseNetwork will parse the network shape n, which is either the name of a preset, profile or a JSON object with
+// download, upload and latency.
+// Returns *networkShape and error.
+func parseNetwork(n string) (*networkShape, error) {
+	n = strings.Trim(n, trim)
+
+	if strings.ToLower(n) == "profile" {
+		return &networkShape{profile: true}, nil
+	}
+
+	if !strings.HasPrefix(n, "{") {
+		shape, ok := networkPresets[strings.ToLower(n)]
+		if !ok {
+			presets := []string{}
+			for name := range networkPresets {
+				presets = append(presets, name)
+			}
+			sort.Strings(presets)
+
+			return nil, fmt.Errorf("Network %s is not supported. Supported presets are %s and profile", n, presets)
+		}
+		return &shape, nil
+	}
+
+	shape := new(networkShape)
+	err := json.Unmarshal([]byte(n), shape)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't unmarshal network. %s", err.Error())
+	}
+
+	if shape.Download < 0 || shape.Upload < 0 || shape.Latency < 0 {
+		return nil, fmt.Errorf("Network download, upload and latency can't be negative")
+	}
+
+	return shape, nil
+}
+
+// network will return the network shape for the job j. The jobs network takes precedence over the Servers.
+// If the network is profile the preset of the jobs browser profile is used, and without a profile nothing is shaped.
+// Returns networkShape.
+func (j *job) network() networkShape {
+	shape := networkShape{}
+	switch {
+	case j.networkShape != nil:
+		shape = *j.networkShape
+
+	case j.srv != nil:
+		shape = j.srv.network
+	}
+
+	if shape.profile {
+		return networkPresets[browserProfiles[j.profile].network]
+	}
+
+	return shape
+}
+
+// bandwidth contains the download and upload shapers shared by all connections of a virtual user.
+type bandwidth struct {
+	download *shaper
+	upload   *shaper
+}
+
+// newBandwidth will create the shapers for the download and upload rate of the network shape n.
+// Returns *bandwidth.
+func newBandwidth(n networkShape) *bandwidth {
+	return &bandwidth{download: newShaper(n.Download), upload: newShaper(n.Upload)}
+}
+
+// bandwidth will return the bandwidth of the network shape of the job j, shared by all jobs of the same virtual user.
+// Returns *bandwidth or nil if the network isn't shaped.
+func (j *job) bandwidth() *bandwidth {
+	n := j.network()
+	if !n.shaped() {
+		return nil
+	}
+
+	if j.workerBandwidth == nil {
+		j.workerBandwidth = make(map[networkShape]*bandwidth)
+	}
+
+	b, ok := j.workerBandwidth[n]
+	if !ok {
+		b = newBandwidth(n)
+		j.workerBandwidth[n] = b
+	}
+	return b
+}
+
+// shapedDialer will return a DialContext function that shapes every connection dialed with dial to the latency of
+// network shape n and the bandwidth b, which is shared by all the connections. The latency is also added once when
+// the connection is established.
+// Returns func(context.Context, string, string) (net.Conn, error).
+func shapedDialer(dial func(context.Context, string, string) (net.Conn, error), n networkShape, b *bandwidth) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		latency := time.Duration(n.Latency) * time.Millisecond
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			conn.Close()
+			return nil, ctx.Err()
+		}
+
+		return &shapedConn{
+			Conn:      conn,
+			latency:   latency,
+			bandwidth: b,
+			closed:    make(chan struct{}),
+		}, nil
+	}
+}
+
+// shapedConn is a net.Conn shaped to a bandwidth and latency. Data read after a write, which is when the
+// response of a request is received, is delayed by the latency on top of the round trip of the connection.
+// The delays end early at the read and write deadlines, and when the connection is closed, which is how
+// the transport cancels a request.
+type shapedConn struct {
+	net.Conn
+	*bandwidth
+
+	latency time.Duration
+
+	mu            sync.Mutex
+	lastWrite     time.Time
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Read will read from the connection at the download rate, adding the latency if data was written since the last read.
+// The transport may already be waiting in Read when the request is written, so the latency is added after the read.
+// Data can't be received before the request would have been sent at the upload rate, so the latency is added from then.
+// Returns int and error.
+func (c *shapedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(c.download.limit(p))
+
+	c.mu.Lock()
+	lastWrite := c.lastWrite
+	c.lastWrite = time.Time{}
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	if !lastWrite.IsZero() {
+		if time.Now().After(lastWrite) {
+			lastWrite = time.Now()
+		}
+
+		if werr := c.wait(lastWrite.Add(c.latency), deadline); werr != nil {
+			return n, werr
+		}
+	}
+
+	if werr := c.wait(c.download.reserve(n), deadline); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// Write will write to the connection at the upload rate. The time the data would have been sent at the upload rate
+// is recorded before waiting for it, since the response may be read before Write returns.
+// Returns int and error.
+func (c *shapedConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := c.Conn.Write(c.upload.limit(p[written:]))
+		written += n
+
+		sent := c.upload.reserve(n)
+		c.mu.Lock()
+		c.lastWrite = sent
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+
+		if err != nil {
+			return written, err
+		}
+
+		if err := c.wait(sent, deadline); err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// wait will wait until the time t, but not past the deadline d or after the connection has been closed.
+// Returns os.ErrDeadlineExceeded if the deadline was reached before t, net.ErrClosed if the connection
+// was closed and otherwise nil.
+func (c *shapedConn) wait(t time.Time, d time.Time) error {
+	if !time.Now().Before(t) {
+		return nil
+	}
+
+	exceeded := !d.IsZero() && d.Before(t)
+	if exceeded {
+		t = d
+	}
+
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-c.closed:
+		return net.ErrClosed
+	}
+
+	if exceeded {
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// Close will close the connection and end any delay of a Read or Write in progress.
+// Returns error.
+func (c *shapedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+// SetDeadline will set the read and write deadlines of the connection, which also limit the delays of the shaping.
+// Returns error.
+func (c *shapedConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline will set the read deadline of the connection, which also limits the delays of Read.
+// Returns error.
+func (c *shapedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline will set the write deadline of the connection, which also limits the delays of Write.
+// Returns error.
+func (c *shapedConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// shaper limits the rate of data in one direction of the connections of a virtual user.
+type shaper struct {
+	rate int64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// newShaper will create a new shaper for rate bytes per second, or nil if rate is 0.
+// Returns *shaper.
+func newShaper(rate int64) *shaper {
+	if rate <= 0 {
+		return nil
+	}
+	return &shaper{rate: rate}
+}
+
+// limit will limit the buffer p to the max number of bytes that should be transferred at once.
+// Returns []byte.
+func (s *shaper) limit(p []byte) []byte {
+	if s == nil {
+		return p
+	}
+
+	chunk := int(s.rate * int64(shapeInterval) / int64(time.Second))
+	if chunk < minShapeChunk {
+		chunk = minShapeChunk
+	}
+
+	if len(p) > chunk {
+		return p[:chunk]
+	}
+	return p
+}
+
+// reserve will reserve the transfer of n bytes at the rate of the shaper, after any earlier transfers.
+// Returns the time the n bytes would have been transferred.
+func (s *shaper) reserve(n int) time.Time {
+	now := time.Now()
+	if s == nil || n <= 0 {
+		return now
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.next.Before(now) {
+		s.next = now
+	}
+	s.next = s.next.Add(time.Duration(int64(n) * int64(time.Second) / s.rate))
+
+	return s.next
+}
+
+// SetNetwork sets the network shape n of the built-in client for all jobs. n is either the name of a preset,
+// 2g, 3g, 4g, dsl, wifi or none, profile to use the preset of each jobs browser profile, or a JSON object with
+// download and upload in bytes per second and latency in milliseconds per round trip. The bandwidth is shared by
+// all connections of a virtual user. Can be overridden per job by the @network statement.
+// Returns error.
+func (srv *Server) SetNetwork(n string) error {
+	if srv.running {
+		return fmt.Errorf("Couldn't set network in *Server.SetNetwork. The Server is already running")
+	}
+
+	shape, err := parseNetwork(n)
+	if err != nil {
+		return fmt.Errorf("Couldn't set network in *Server.SetNetwork. %s", err.Error())
+	}
+
+	srv.network = *shape
+	return nil
+}
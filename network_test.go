@@ -0,0 +1,210 @@
+package steptest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNetwork(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if r.Method == "GET" {
+			w.Write([]byte(strings.Repeat("a", 20000)))
+		}
+	}))
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+	network := "- @network { \"download\": 100000, \"upload\": 50000, \"latency\": 50 }\n"
+
+	for _, test := range []struct {
+		name     string
+		steps    string
+		minTTFB  time.Duration
+		minTotal time.Duration
+		maxTotal time.Duration
+	}{
+		// The latency is added when connecting and for every round trip, and 20000 bytes takes 200ms at 100000 bytes per second.
+		{"download", network + "- get " + ts.URL + "\n", 100 * time.Millisecond, 250 * time.Millisecond, 0},
+		// 10000 bytes takes 200ms to send at 50000 bytes per second.
+		{"upload", network + "- post " + ts.URL + " " + strings.Repeat("b", 10000) + "\n", 0, 200 * time.Millisecond, 0},
+		// The latency is added to the round trip of the server.
+		{"round trip", network + "- delete " + ts.URL + "/slow\n", 150 * time.Millisecond, 0, 0},
+		// Without shaping the same request is fast.
+		{"unshaped", "- get " + ts.URL + "\n", 0, 0, 100 * time.Millisecond},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			j, err := srv.parseJob(&rawJob{steps: test.steps})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := srv.fetchJob(j, srv.fetchFunc)
+			if r.Err != nil {
+				t.Fatal(r.Err.Error)
+			}
+
+			timing := r.Steps[len(r.Steps)-1].Timing
+			if timing.TimeToFirstByte < test.minTTFB || timing.Total < test.minTotal {
+				t.Errorf("Expected time to first byte of at least %s and total of at least %s but got %s and %s", test.minTTFB, test.minTotal, timing.TimeToFirstByte, timing.Total)
+			}
+
+			if test.maxTotal != 0 && timing.Total > test.maxTotal {
+				t.Errorf("Expected total of at most %s but got %s", test.maxTotal, timing.Total)
+			}
+		})
+	}
+}
+
+func TestShapedConnDeadline(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		f    func(c *shapedConn) error
+	}{
+		// 10000 bytes takes 1s to send at 10000 bytes per second.
+		{"write", func(c *shapedConn) error {
+			c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+			_, err := c.Write([]byte(strings.Repeat("a", 10000)))
+			return err
+		}},
+		// The response of a write is delayed by the latency of 1s.
+		{"read", func(c *shapedConn) error {
+			c.SetDeadline(time.Now().Add(100 * time.Millisecond))
+			c.Write([]byte("a"))
+			_, err := c.Read(make([]byte, 1))
+			return err
+		}},
+		// Closing the connection ends the delay.
+		{"close", func(c *shapedConn) error {
+			time.AfterFunc(100*time.Millisecond, func() { c.Close() })
+			c.Write([]byte("a"))
+			_, err := c.Read(make([]byte, 1))
+			return err
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go io.Copy(server, server)
+
+			c := &shapedConn{Conn: client, bandwidth: newBandwidth(networkShape{Upload: 10000}), latency: time.Second, closed: make(chan struct{})}
+			defer c.Close()
+
+			start := time.Now()
+			err := test.f(c)
+			if d := time.Since(start); d > 500*time.Millisecond {
+				t.Errorf("Expected the %s to end within %s but got %s", test.name, 500*time.Millisecond, d)
+			}
+
+			expected := os.ErrDeadlineExceeded
+			if test.name == "close" {
+				expected = net.ErrClosed
+			}
+			if !errors.Is(err, expected) {
+				t.Errorf("Expected %s but got %v", expected, err)
+			}
+		})
+	}
+}
+
+func TestSharedBandwidth(t *testing.T) {
+	n := networkShape{Download: 10000, Latency: 10}
+
+	// Jobs of the same virtual user share the bandwidth.
+	shapes := make(map[networkShape]*bandwidth)
+	a, b := &job{networkShape: &n, workerBandwidth: shapes}, &job{networkShape: &n, workerBandwidth: shapes}
+	if a.bandwidth() == nil || a.bandwidth() != b.bandwidth() {
+		t.Errorf("Expected the jobs to share the bandwidth")
+	}
+
+	dial := shapedDialer(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go server.Write(make([]byte, 1000))
+		return client, nil
+	}, n, a.bandwidth())
+
+	// Two connections reading 1000 bytes each takes 200ms at 10000 bytes per second.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		conn, err := dial(context.Background(), "tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.ReadFull(conn, make([]byte, 1000))
+		}()
+	}
+	wg.Wait()
+
+	if d := time.Since(start); d < 180*time.Millisecond {
+		t.Errorf("Expected the connections to share the bandwidth and take at least 180ms but got %s", d)
+	}
+
+	// The latency when connecting is cancelled with the context.
+	n.Latency = 10000
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start = time.Now()
+	if _, err := shapedDialer(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		client, _ := net.Pipe()
+		return client, nil
+	}, n, newBandwidth(n))(ctx, "tcp", "example.com:80"); err == nil || time.Since(start) > time.Second {
+		t.Errorf("Expected the dial to be cancelled but got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestNetworkProfile(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+	if err := srv.SetNetwork("profile"); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := srv.parseJob(&rawJob{steps: "- @profiles { \"safari-iphone\": 1 }\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := j.network(); n != networkPresets["4g"] {
+		t.Errorf("Expected the 4g network of the safari-iphone profile but got %+v", n)
+	}
+
+	// The @network statement takes precedence over the Server.
+	j, _ = srv.parseJob(&rawJob{steps: "- @profiles { \"safari-iphone\": 1 }\n- @network 3G\n"})
+	if n := j.network(); n != networkPresets["3g"] {
+		t.Errorf("Expected the 3g network but got %+v", n)
+	}
+
+	// Without a profile nothing is shaped.
+	j, _ = srv.parseJob(&rawJob{steps: ""})
+	if n := j.network(); n.shaped() {
+		t.Errorf("Expected no shaping without a profile but got %+v", n)
+	}
+}
+
+func TestCreateNetwork(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+
+	for _, a := range []string{"5g", "{ \"download\": -1 }", "{ \"latency\": \"fast\" }"} {
+		if _, err := srv.parseJob(&rawJob{steps: "- @network " + a + "\n"}); err == nil {
+			t.Errorf("Expected error for invalid @network %s but got nil", a)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+)
+
+const (
+	defaultUserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_13_3) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/64.0.3282.186 Safari/537.36" // defaultUserAgent is used when no profiles has been set.
+
+	acceptChrome  = "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7" // acceptChrome is the Accept header of Chromium based browsers.
+	acceptDefault = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"                                                                         // acceptDefault is the Accept header of Firefox and Safari.
+)
+
+// browserProfile contains the headers a browser sends with every request and the network preset used when
+// the network is set to profile. Accept-Encoding only contains the encodings that are decoded by StepTest.
+type browserProfile struct {
+	userAgent      string
+	accept         string
+	acceptLanguage string
+	acceptEncoding string
+	network        string
+}
+
+var (
+	// Built-in browser profiles for the @profiles statement and *Server.SetProfiles.
+	browserProfiles = map[string]browserProfile{
+		"chrome-windows": {
+			userAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/141.0.0.0 Safari/537.36",
+			accept:         acceptChrome,
+			acceptLanguage: "en-US,en;q=0.9",
+			acceptEncoding: "gzip, deflate, br",
+			network:        "wifi",
+		},
+		"chrome-mac": {
+			userAgent:      "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/141.0.0.0 Safari/537.36",
+			accept:         acceptChrome,
+			acceptLanguage: "en-US,en;q=0.9",
+			acceptEncoding: "gzip, deflate, br",
+			network:        "wifi",
+		},
+		"chrome-android": {
+			userAgent:      "Mozilla/5.0 (Linux; Android 10; K) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/141.0.0.0 Mobile Safari/537.36",
+			accept:         acceptChrome,
+			acceptLanguage: "en-US,en;q=0.9",
+			acceptEncoding: "gzip, deflate, br",
+			network:        "4g",
+		},
+		"edge-windows": {
+			userAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/141.0.0.0 Safari/537.36 Edg/141.0.0.0",
+			accept:         acceptChrome,
+			acceptLanguage: "en-US,en;q=0.9",
+			acceptEncoding: "gzip, deflate, br",
+			network:        "wifi",
+		},
+		"firefox-windows": {
+			userAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:143.0) Gecko/20100101 Firefox/143.0",
+			accept:         acceptDefault,
+			acceptLanguage: "en-US,en;q=0.5",
+			acceptEncoding: "gzip, deflate, br",
+			network:        "wifi",
+		},
+		"firefox-linux": {
+			userAgent:      "Mozilla/5.0 (X11; Linux x86_64; rv:143.0) Gecko/20100101 Firefox/143.0",
+			accept:         acceptDefault,
+			acceptLanguage: "en-US,en;q=0.5",
+			acceptEncoding: "gzip, deflate, br",
+			network:        "wifi",
+		},
+		"safari-mac": {
+			userAgent:      "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/26.0 Safari/605.1.15",
+			accept:         acceptDefault,
+			acceptLanguage: "en-US,en;q=0.9",
+			acceptEncoding: "gzip, deflate, br",
+			network:        "wifi",
+		},
+		"safari-iphone": {
+			userAgent:      "Mozilla/5.0 (iPhone; CPU iPhone OS 18_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/26.0 Mobile/15E148 Safari/604.1",
+			accept:         acceptDefault,
+			acceptLanguage: "en-US,en;q=0.9",
+			acceptEncoding: "gzip, deflate, br",
+			network:        "4g",
+		},
+	}
+)
+
+// profileNames returns the sorted names of the built-in browser profiles.
+// Returns []string.
+func profileNames() []string {
+	names := []string{}
+	for name := range browserProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseProfiles will validate the weighted pool of profiles p. The weight decides how often a profile
+// is picked compared to the others in the pool.
+// Returns error.
+func parseProfiles(p map[string]int) error {
+	if len(p) == 0 {
+		return fmt.Errorf("No profiles were supplied")
+	}
+
+	for name, weight := range p {
+		if _, ok := browserProfiles[name]; !ok {
+			return fmt.Errorf("Profile %s is not supported. Supported profiles are %s", name, profileNames())
+		}
+
+		if weight < 1 {
+			return fmt.Errorf("Profile %s needs a weight of at least 1", name)
+		}
+	}
+
+	return nil
+}
+
+// pickProfile will pick a profile from the weighted pool of profiles p.
+// Returns string with the name of the profile, or an empty string if the pool is empty.
+func pickProfile(p map[string]int) string {
+	// Iterate in a stable order so that the pick only depends on the random number.
+	names, total := []string{}, 0
+	for name, weight := range p {
+		names = append(names, name)
+		total += weight
+	}
+	sort.Strings(names)
+
+	if total == 0 {
+		return ""
+	}
+
+	n := rand.Intn(total)
+	for _, name := range names {
+		n -= p[name]
+		if n < 0 {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// setProfile will pick the profile of the job j from the weighted pool of the @profiles statement,
+// or from the Servers pool if the job has none.
+func (j *job) setProfile() {
+	pool := j.profiles
+	if pool == nil && j.srv != nil {
+		pool = j.srv.profiles
+	}
+
+	j.profile = pickProfile(pool)
+}
+
+// setProfileHeaders will set the User-Agent, Accept, Accept-Language and Accept-Encoding headers of the
+// jobs j profile on the request req. Without a profile only the default User-Agent and Accept-Encoding will be set.
+// Any headers set by the header and @header statements are set after these and will always win.
+func (j *job) setProfileHeaders(req *http.Request) {
+	p, ok := browserProfiles[j.profile]
+	if !ok {
+		req.Header.Set("User-Agent", defaultUserAgent)
+		req.Header.Set("Accept-Encoding", defaultAcceptEncoding)
+		return
+	}
+
+	req.Header.Set("User-Agent", p.userAgent)
+	req.Header.Set("Accept", p.accept)
+	req.Header.Set("Accept-Language", p.acceptLanguage)
+	req.Header.Set("Accept-Encoding", p.acceptEncoding)
+}
+
+// SetProfiles sets the weighted pool of browser profiles p that every job picks its profile from. The weight
+// decides how often a profile is picked compared to the others in the pool. A profile sets a coherent User-Agent,
+// Accept, Accept-Language and Accept-Encoding header set. Can be overridden per job by the @profiles statement.
+// Returns error.
+func (srv *Server) SetProfiles(p map[string]int) error {
+	if srv.running {
+		return fmt.Errorf("Couldn't set profiles in *Server.SetProfiles. The Server is already running")
+	}
+
+	if err := parseProfiles(p); err != nil {
+		return fmt.Errorf("Couldn't set profiles in *Server.SetProfiles. %s", err.Error())
+	}
+
+	srv.profiles = p
+	return nil
+}
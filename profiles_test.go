@@ -0,0 +1,133 @@
+package steptest
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newHeaderEchoServer will start a server that appends the headers of every request to received. The response is
+// token=zipped; gzipped if the request accepts gzip and otherwise token=plain;, so that varfrom shows the decoding.
+func newHeaderEchoServer(received *[]http.Header) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*received = append(*received, r.Header.Clone())
+
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte("token=plain;"))
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("token=zipped;"))
+		gz.Close()
+	}))
+}
+
+func TestProfiles(t *testing.T) {
+	var received []http.Header
+	ts := newHeaderEchoServer(&received)
+	defer ts.Close()
+
+	srv, err := New(1, 5000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.SetProfiles(map[string]int{"chrome-windows": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := "- @profiles { \"firefox-windows\": 1 }\n"
+	steps += "- @header { \"name\": \"X-Token\", \"value\": \"{{token}}\" }\n"
+	steps += "- var { \"name\": \"token\", \"value\": \"first\" }\n"
+	steps += "- get " + ts.URL + "\n"
+	steps += "  varfrom { \"from\": \"body\", \"name\": \"token\", \"find\": \"token={{StepTestSyntax}};\" }\n"
+	steps += "- get " + ts.URL + "\n"
+	steps += "  header { \"name\": \"User-Agent\", \"value\": \"custom-agent\" }\n"
+
+	j, err := srv.parseJob(&rawJob{steps: steps})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	if r.Profile != "firefox-windows" {
+		t.Errorf("Expected the @profiles pool to override the Servers pool but got profile %s", r.Profile)
+	}
+
+	firefox := browserProfiles["firefox-windows"]
+	if ua := received[0].Get("User-Agent"); ua != firefox.userAgent {
+		t.Errorf("Expected User-Agent %s but got %s", firefox.userAgent, ua)
+	}
+
+	if ua := received[1].Get("User-Agent"); ua != "custom-agent" {
+		t.Errorf("Expected the header statement to override the User-Agent but got %s", ua)
+	}
+
+	if accept := received[1].Get("Accept"); accept != firefox.accept {
+		t.Errorf("Expected Accept %s but got %s", firefox.accept, accept)
+	}
+
+	// The gzipped body should be decoded before the variable is extracted, and the
+	// global header must get the new value of the variable in the second step.
+	if token := received[1].Get("X-Token"); token != "zipped" {
+		t.Errorf("Expected X-Token header zipped but got %s", token)
+	}
+
+	if token := j.globalHeaders[0].Value; token != "{{token}}" {
+		t.Errorf("Expected the global header to be unchanged but got %s", token)
+	}
+
+}
+
+func TestDefaultUserAgent(t *testing.T) {
+	var received []http.Header
+	ts := newHeaderEchoServer(&received)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+	j, err := srv.parseJob(&rawJob{steps: "- get " + ts.URL + "\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	if ua := received[0].Get("User-Agent"); ua != defaultUserAgent {
+		t.Errorf("Expected the default User-Agent without profiles but got %s", ua)
+	}
+}
+
+func TestSetProfilesInvalid(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+
+	for _, p := range []map[string]int{{}, {"netscape": 1}, {"chrome-mac": 0}} {
+		if err := srv.SetProfiles(p); err == nil {
+			t.Errorf("Expected error for invalid profiles %v but got nil", p)
+		}
+	}
+}
+
+func TestPickProfile(t *testing.T) {
+	picks := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		picks[pickProfile(map[string]int{"chrome-windows": 3, "safari-iphone": 1})]++
+	}
+
+	if picks["chrome-windows"] < 2700 || picks["chrome-windows"] > 3300 || picks["chrome-windows"]+picks["safari-iphone"] != 4000 {
+		t.Errorf("Expected about 3000 chrome-windows and 1000 safari-iphone picks but got %v", picks)
+	}
+
+	if p := pickProfile(nil); p != "" {
+		t.Errorf("Expected no profile from an empty pool but got %s", p)
+	}
+}
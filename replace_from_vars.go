@@ -4,7 +4,6 @@ package steptest
 import (
 	"encoding/json"
 	"fmt"
-	"net/http"
 	"strings"
 )
 
@@ -13,21 +12,84 @@ const (
 	searchSyntax        = "{{StepTestSyntax}}" // searchSyntax used by VARFROM to look for patterns in BODY/HEADER.
 	searchSyntaxReplace = ").+("               // searchSyntaxReplace is what we replace searchSyntax with in our regular expression.
 	searchSyntaxRegexp  = "(%s)"               // searchSyntaxRegexp is what we encapsulate the whole search string to make a regular expression.
+	bodyExcerptLength   = 512                  // bodyExcerptLength is the max number of bytes of a body to include in errors.
 )
 
 // replaceFromVariables will run replacement functions on data based on the variables stored in job j.
-// It will replace the variables found in either URL, Body, Headers or Cookies with those stored in the jobs variables.
+// It will replace the variables found in either URL, Body or Headers with those stored in the jobs variables.
+// Cookies are replaced when they are added to the jobs cookie jar.
 func (j *job) replaceFromVariables(s *step) {
+	// Copy the global headers so that replacing variables never changes the jobs global headers.
+	// The local headers are set after the global ones so that they take precedence.
+	headers := make([]header, 0, len(j.globalHeaders)+len(s.headers))
+	headers = append(headers, j.globalHeaders...)
+	s.headers = append(headers, s.headers...)
+
 	// Replace from variables.
-	s.headers = append(j.globalHeaders, s.headers...)
-	s.cookies = append([]http.Cookie{}, j.cookies...)
 
 	for n, v := range j.vars {
 		j.varReplaceURL(s, &n, &v)
 		j.varReplaceBody(s, &n, &v)
 		j.varReplaceHeaders(s, &n, &v)
-		j.varReplaceCookies(s, &n, &v)
+		j.varReplaceExpect(s, &n, &v)
+	}
+
+	// The body of GraphQL steps is created after the replacement so that the values are JSON escaped.
+	if s.graphql != nil {
+		s.body = j.graphQLBody(s.graphql)
+	}
+}
+
+// replaceVariables will replace every occurrence of the jobs j variables in string str.
+// Returns string.
+func (j *job) replaceVariables(str string) string {
+	for n, v := range j.vars {
+		str = strings.Replace(str, fmt.Sprintf(replaceVarSyntax, n), v, -1)
 	}
+	return str
+}
+
+// replaceJSONVariables will replace every occurrence of the jobs j variables in the JSON text str.
+// Values inside string literals are JSON escaped, while values outside of them are inserted as is.
+// Returns string.
+func (j *job) replaceJSONVariables(str string) string {
+	b := strings.Builder{}
+	inString := false
+
+	for i := 0; i < len(str); i++ {
+		switch {
+		case inString && str[i] == '\\' && i+1 < len(str):
+			b.WriteString(str[i : i+2])
+			i++
+			continue
+
+		case str[i] == '"':
+			inString = !inString
+
+		case strings.HasPrefix(str[i:], "{{"):
+			end := strings.Index(str[i:], "}}")
+			if end == -1 {
+				break
+			}
+
+			v, ok := j.vars[str[i+2:i+end]]
+			if !ok {
+				break
+			}
+
+			if inString {
+				escaped, _ := json.Marshal(v)
+				v = string(escaped[1 : len(escaped)-1])
+			}
+			b.WriteString(v)
+			i += end + 1
+			continue
+		}
+
+		b.WriteByte(str[i])
+	}
+
+	return b.String()
 }
 
 // varReplaceURL will replace every occurrence of name n with value v in the URL.
@@ -49,11 +111,14 @@ func (j *job) varReplaceHeaders(s *step, n *string, v *string) {
 	}
 }
 
-// varReplaceCookies will copy the jobs cookies and replace every occurrence of name n with value v in cookies.
-// When done it will overwrite the the steps cookies value with the replaced cookies.
-func (j *job) varReplaceCookies(s *step, n *string, v *string) {
-	for i := range s.cookies {
-		s.cookies[i].Value = strings.Replace(s.cookies[i].Value, fmt.Sprintf(replaceVarSyntax, *n), *v, -1)
+// varReplaceExpect will replace every occurrence of name n with value v in the values of the expectations.
+// Status, regexp and time expectations are parsed when the job is parsed and will not be replaced.
+func (j *job) varReplaceExpect(s *step, n *string, v *string) {
+	for i := range s.expect {
+		switch s.expect[i].Type {
+		case "contains", "notcontains", "json", "header":
+			s.expect[i].Value = strings.Replace(s.expect[i].Value, fmt.Sprintf(replaceVarSyntax, *n), *v, -1)
+		}
 	}
 }
 
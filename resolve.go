@@ -0,0 +1,103 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// parseResolve will validate the host:port h and the address to dial a instead, which is either an ip or ip:port.
+// If a has no port the port of h is used.
+// Returns the address to dial and error.
+func parseResolve(h string, a string) (string, error) {
+	_, port, err := net.SplitHostPort(h)
+	if err != nil || port == "" {
+		return "", fmt.Errorf("Couldn't parse %s as host:port", h)
+	}
+
+	if net.ParseIP(a) != nil {
+		return net.JoinHostPort(a, port), nil
+	}
+
+	ip, p, err := net.SplitHostPort(a)
+	if err != nil || net.ParseIP(ip) == nil || p == "" {
+		return "", fmt.Errorf("Couldn't parse %s as ip or ip:port", a)
+	}
+
+	return a, nil
+}
+
+// resolveKey will return the DNS overrides for the job j as a string, with the jobs overrides taking
+// precedence over the Servers.
+// Returns string.
+func (j *job) resolveKey() string {
+	if j.srv == nil {
+		return resolveKey(j.resolve)
+	}
+	return resolveKey(j.srv.resolve, j.resolve)
+}
+
+// resolveKey will merge the DNS overrides r into a string, with the later overrides taking precedence.
+// The key is part of the client key so that connections dialed with different overrides are never shared.
+// Returns string.
+func resolveKey(r ...map[string]string) string {
+	m := make(map[string]string)
+	for _, overrides := range r {
+		for h, a := range overrides {
+			m[h] = a
+		}
+	}
+
+	entries := []string{}
+	for h, a := range m {
+		entries = append(entries, h+"="+a)
+	}
+	sort.Strings(entries)
+
+	return strings.Join(entries, ",")
+}
+
+// resolveDialer will return a DialContext function dialing with dialer d, where any address in the DNS overrides
+// of key r is replaced with its override. The Host header and SNI are unchanged since they are taken from the URL.
+// Returns func(context.Context, string, string) (net.Conn, error).
+func resolveDialer(d *net.Dialer, r string) func(context.Context, string, string) (net.Conn, error) {
+	m := make(map[string]string)
+	for _, entry := range strings.Split(r, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 2 {
+			m[strings.ToLower(parts[0])] = parts[1]
+		}
+	}
+
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		if override, ok := m[strings.ToLower(addr)]; ok {
+			addr = override
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+// SetResolve sets DNS overrides r for the built-in client for all jobs. The keys are host:port and the values are the ip
+// or ip:port to connect to instead. The Host header and SNI are unchanged. Overrides from the @resolve statement take
+// precedence. Overrides don't apply to the target of requests sent through a proxy, only to the proxy itself.
+// Returns error.
+func (srv *Server) SetResolve(r map[string]string) error {
+	if srv.running {
+		return fmt.Errorf("Couldn't set resolve in *Server.SetResolve. The Server is already running")
+	}
+
+	resolve := make(map[string]string)
+	for h, a := range r {
+		addr, err := parseResolve(h, a)
+		if err != nil {
+			return fmt.Errorf("Couldn't set resolve in *Server.SetResolve. %s", err.Error())
+		}
+		resolve[strings.ToLower(h)] = addr
+	}
+
+	srv.resolve = resolve
+	return nil
+}
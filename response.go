@@ -0,0 +1,194 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultStreamLineLength = 64 * 1024 // defaultStreamLineLength is the max length of a line in the stream mode if no limit was supplied.
+)
+
+var (
+	// Allowed modes for the response statement and *Server.SetResponseMode.
+	allowedResponseModes = []string{"full", "capture", "discard", "stream"}
+)
+
+// responseMode contains how the body of a response should be read. Full reads the whole body into memory,
+// capture reads up to limit bytes, discard doesn't keep anything and stream only keeps the lines that match
+// any body extractor. The rest of the body is always drained so that the connection can be reused.
+type responseMode struct {
+	Mode  string `json:"mode"`
+	Limit int64  `json:"limit"`
+}
+
+// parse will validate the response mode r and set any default values.
+// Returns error.
+func (r *responseMode) parse() error {
+	r.Mode = strings.ToLower(r.Mode)
+
+	switch r.Mode {
+	case "capture":
+		if r.Limit < 1 {
+			return fmt.Errorf("Response mode capture needs a limit of at least 1")
+		}
+
+	case "stream":
+		if r.Limit < 0 {
+			return fmt.Errorf("Response mode stream needs a positive limit")
+		}
+		if r.Limit == 0 {
+			r.Limit = defaultStreamLineLength
+		}
+
+	case "full", "discard":
+
+	default:
+		return fmt.Errorf("Response mode %s is not supported. Supported modes are %s", r.Mode, allowedResponseModes)
+	}
+
+	return nil
+}
+
+// responseMode will return the response mode to use for step s. The steps mode takes precedence over the Servers.
+// Returns responseMode.
+func (j *job) responseMode(s *step) responseMode {
+	switch {
+	case s.responseMode.Mode != "":
+		return s.responseMode
+
+	case j.srv != nil && j.srv.responseMode.Mode != "":
+		return j.srv.responseMode
+	}
+
+	return responseMode{Mode: "full"}
+}
+
+// readBody will read the body b of the response for step s according to the response mode m. In the stream mode
+// only the lines matching the BODY varfrom items, the body expectations or the body pattern of the error policy p
+// are kept. Lines longer than the limit are split.
+// Returns the body, true if it was truncated by the capture limit and error.
+func (j *job) readBody(s *step, b io.Reader, m responseMode, p errorPolicy) ([]byte, bool, error) {
+	switch m.Mode {
+	case "discard":
+		return []byte{}, false, nil
+
+	case "capture":
+		raw, err := ioutil.ReadAll(io.LimitReader(b, m.Limit+1))
+		if int64(len(raw)) > m.Limit {
+			return raw[:m.Limit], true, err
+		}
+		return raw, false, err
+
+	case "stream":
+		return j.streamBody(s, b, m.Limit, p)
+	}
+
+	raw, err := ioutil.ReadAll(b)
+	return raw, false, err
+}
+
+// readErrorBody will read the body b of a response with an error status according to the response mode m.
+// The full mode reads the whole body, capture up to its limit and discard and stream only an excerpt of it.
+// Returns []byte.
+func (*job) readErrorBody(b io.Reader, m responseMode) []byte {
+	limit := int64(bodyExcerptLength)
+	switch m.Mode {
+	case "full":
+		limit = -1
+
+	case "capture":
+		limit = m.Limit
+	}
+
+	if limit >= 0 {
+		b = io.LimitReader(b, limit)
+	}
+
+	raw, err := ioutil.ReadAll(b)
+	if err != nil {
+		return []byte("")
+	}
+	return raw
+}
+
+// streamBody will read the body b for step s line by line, with lines of at most l bytes, and only keep the lines
+// matching any body extractor of step s or the body pattern of the error policy p.
+// Returns the kept lines, false and error.
+func (j *job) streamBody(s *step, b io.Reader, l int64, p errorPolicy) ([]byte, bool, error) {
+	matchers := []func([]byte) bool{}
+	if p.body != nil {
+		matchers = append(matchers, p.body.Match)
+	}
+
+	for _, v := range s.varfrom {
+		if strings.ToUpper(v.From) != "BODY" {
+			continue
+		}
+
+		re, err := regexp.Compile(v.Syntax)
+		if err != nil {
+			return nil, false, fmt.Errorf("Couldn't compile regular expression in *job.streamBody. %s", err.Error())
+		}
+		matchers = append(matchers, re.Match)
+	}
+
+	for _, e := range s.expect {
+		switch e.Type {
+		case "contains", "notcontains":
+			value := []byte(e.Value)
+			matchers = append(matchers, func(line []byte) bool { return bytes.Contains(line, value) })
+
+		case "regexp":
+			matchers = append(matchers, e.regexp.Match)
+		}
+	}
+
+	raw := []byte{}
+	r := bufio.NewReaderSize(b, int(l))
+	for {
+		line, err := r.ReadSlice('\n')
+		for _, match := range matchers {
+			if match(line) {
+				raw = append(raw, line...)
+				break
+			}
+		}
+
+		switch err {
+		case nil, bufio.ErrBufferFull:
+
+		case io.EOF:
+			return raw, false, nil
+
+		default:
+			return raw, false, err
+		}
+	}
+}
+
+// SetResponseMode sets how the body of responses should be read for all jobs. Mode m can be full, which reads the whole body,
+// capture which reads up to n bytes, discard which doesn't keep anything or stream which only keeps the lines matching
+// any body extractor, with lines of at most n bytes. The rest of the body is always drained so that the connection
+// can be reused. Can be overridden per step by the response statement. Defaults to full.
+// Returns error.
+func (srv *Server) SetResponseMode(m string, n int64) error {
+	if srv.running {
+		return fmt.Errorf("Couldn't set response mode in *Server.SetResponseMode. The Server is already running")
+	}
+
+	r := responseMode{Mode: m, Limit: n}
+	err := r.parse()
+	if err != nil {
+		return fmt.Errorf("Couldn't set response mode in *Server.SetResponseMode. %s", err.Error())
+	}
+
+	srv.responseMode = r
+	return nil
+}
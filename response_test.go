@@ -0,0 +1,171 @@
+package steptest
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// productPage is the page served by the product server, with a token after 150000 bytes.
+var productPage = strings.Repeat("<p>product</p>\n", 10000) + "<input name=\"token\" value=\"abc123\">\n" + strings.Repeat("<p>footer</p>\n", 100)
+
+// newProductServer will start a server that responds with productPage, with status 404 for /missing.
+// The connections opened to the server are counted in conns.
+func newProductServer(conns *int32) *httptest.Server {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte(productPage))
+	}))
+	ts.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	ts.Start()
+	return ts
+}
+
+func TestResponseMode(t *testing.T) {
+	var conns int32
+	ts := newProductServer(&conns)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+	if err := srv.SetResponseMode("discard", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		statement string
+		truncated bool
+		token     string
+	}{
+		{"discard", "", false, ""},
+		{"capture", "  response { \"mode\": \"capture\", \"limit\": 100 }\n  expect { \"type\": \"contains\", \"value\": \"<p>product</p>\" }\n", true, ""},
+		{"stream", "  response { \"mode\": \"stream\" }\n  varfrom { \"from\": \"body\", \"name\": \"token\", \"find\": \"value=\\\"{{StepTestSyntax}}\\\"\" }\n  expect { \"type\": \"notcontains\", \"value\": \"error\" }\n", false, "abc123"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			j, err := srv.parseJob(&rawJob{steps: "- get " + ts.URL + "\n" + test.statement})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := srv.fetchJob(j, srv.fetchFunc)
+			if r.Err != nil {
+				t.Fatal(r.Err.Error)
+			}
+
+			if j.vars["token"] != test.token {
+				t.Errorf("Expected token %q but got %q", test.token, j.vars["token"])
+			}
+
+			// Every body is drained, so the whole body is counted.
+			if step := r.Steps[0]; step.BodyTruncated != test.truncated || step.BytesReceived != int64(len(productPage)) {
+				t.Errorf("Expected truncated %t and %d bytes received but got %t and %d", test.truncated, len(productPage), step.BodyTruncated, step.BytesReceived)
+			}
+		})
+	}
+}
+
+func TestResponseModeReusesConnection(t *testing.T) {
+	var conns int32
+	ts := newProductServer(&conns)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+	if err := srv.SetResponseMode("discard", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := "- get " + ts.URL + "\n"
+	steps += "- get " + ts.URL + "\n"
+	steps += "  response { \"mode\": \"capture\", \"limit\": 100 }\n"
+	steps += "- get " + ts.URL + "\n"
+	steps += "  response { \"mode\": \"stream\" }\n"
+	steps += "  expect { \"type\": \"notcontains\", \"value\": \"error\" }\n"
+
+	j, err := srv.parseJob(&rawJob{steps: steps})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	// Every body is drained whatever the mode, so the connection is reused.
+	if got := atomic.LoadInt32(&conns); got != 1 {
+		t.Errorf("Expected 1 connection but got %d", got)
+	}
+}
+
+func TestResponseModeErrorBody(t *testing.T) {
+	var conns int32
+	ts := newProductServer(&conns)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+	if err := srv.SetResponseMode("discard", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The body of an error response is limited to an excerpt when discarding.
+	j, _ := srv.parseJob(&rawJob{steps: "- get " + ts.URL + "/missing\n"})
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err == nil || len(r.Err.Body) != bodyExcerptLength {
+		t.Errorf("Expected an error with a body of %d bytes", bodyExcerptLength)
+	}
+}
+
+func TestResponseModeJSON(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"cart":{"id":"c1","items":[{"sku":"sku-1","qty":2}]}}`))
+	}))
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+	if err := srv.SetResponseMode("discard", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Steps decoding the body as JSON read the whole body whatever the response mode is.
+	for _, test := range []struct {
+		name      string
+		statement string
+	}{
+		{"discard", ""},
+		{"capture", "  response { \"mode\": \"capture\", \"limit\": 10 }\n"},
+		{"stream", "  response { \"mode\": \"stream\" }\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			steps := "- get " + ts.URL + "\n" + test.statement
+			steps += "  varfrom { \"from\": \"json\", \"name\": \"sku\", \"find\": \"cart.items[0].sku\" }\n"
+			steps += "  expect { \"type\": \"json\", \"path\": \"cart.id\", \"value\": \"c1\" }\n"
+
+			j, err := srv.parseJob(&rawJob{steps: steps})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := srv.fetchJob(j, srv.fetchFunc)
+			if r.Err != nil || j.vars["sku"] != "sku-1" || r.Steps[0].BodyTruncated {
+				t.Errorf("Expected sku-1 from the whole body but got %s and %v", j.vars["sku"], r.Err)
+			}
+		})
+	}
+}
+
+func TestCreateResponseMode(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+
+	for _, a := range []string{"{ \"mode\": \"capture\" }", "{ \"mode\": \"tee\" }", "{ \"limit\": 10 }"} {
+		if _, err := srv.parseJob(&rawJob{steps: "- get http://example.com\n  response " + a + "\n"}); err == nil {
+			t.Errorf("Expected error for invalid response %s but got nil", a)
+		}
+	}
+}
@@ -4,12 +4,14 @@ package steptest
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 )
 
 // New takes a number of virtual user v and request timeout t and creates a StepTest Server.
 // If c is not nil that function will be used for all requests. This is usefull when you
-// need to sign your requests or do anything else fancy with the them :) :) :).
+// need to do anything fancy with the requests that the built-in client can't :) :) :).
+// AWS Signature Version 4 and HMAC signing is supported by the sign statement.
 // If c is set timeout will be ignored for obvious reasons, so please handle this in your
 // own function if that is the case.
 // Returns *Server and error.
@@ -24,19 +26,26 @@ func New(v int, t int, c func(*http.Request) (*http.Response, error)) (*Server,
 		t = 30000
 	}
 
-	// Default to a simple function if no one was specified.
-	if c == nil {
-		client := &http.Client{Timeout: time.Duration(t) * time.Millisecond}
-		c = func(req *http.Request) (*http.Response, error) { return client.Do(req) }
-	}
-
 	srv := &Server{
 		fetchWorkers:         v,
 		fetchFunc:            c,
+		timeout:              time.Duration(t) * time.Millisecond,
 		addedJobsCounterChan: make(chan int),
 		parsedJobs:           make(chan *job),
 		resultJobs:           make(chan []*Result),
 		resultCounterChan:    make(chan int),
+		tokens:               newTokenCache(),
+		grpcConns:            newGRPCConnSet(),
+	}
+
+	// Default to the built-in client if no function was specified.
+	switch {
+	case c == nil:
+		srv.clients = srv.newClientSet()
+		srv.fetchFunc = srv.clients.fetch
+
+	default:
+		srv.customFetch = true
 	}
 
 	return srv, nil
@@ -87,6 +96,69 @@ func (srv *Server) closeRunning() {
 	srv.endTime = time.Now()
 }
 
+// SetErrorStatuses sets which status codes v that should count as failures for all jobs. Status codes are separated by
+// commas and can be either a single code (404), a range (400-499) or a class (5xx). Defaults to any status code 400 or above.
+// Can be overridden per job and step by the @errors and errors statements.
+// Returns error.
+func (srv *Server) SetErrorStatuses(v string) error {
+	statuses, err := parseStatusRanges(v)
+	if err != nil {
+		return fmt.Errorf("Couldn't set error statuses in *Server.SetErrorStatuses. %s", err.Error())
+	}
+
+	srv.errorPolicy.Statuses, srv.errorPolicy.statuses = v, statuses
+	return nil
+}
+
+// SetTransportErrors sets which classes of transport errors c that should count as failures for all jobs.
+// Supported classes are all, timeout, dns, refused, reset, tls and other. Calling it without any classes
+// will make no transport errors count as failures. Defaults to all.
+// Returns error.
+func (srv *Server) SetTransportErrors(c ...string) error {
+	e := &errorPolicy{Transport: append([]string{}, c...)}
+	err := e.parse()
+	if err != nil {
+		return fmt.Errorf("Couldn't set transport errors in *Server.SetTransportErrors. %s", err.Error())
+	}
+
+	srv.errorPolicy.Transport = e.Transport
+	return nil
+}
+
+// SetErrorBody sets a regular expression p that will make any response with a body matching it count as a failure for all jobs.
+// Returns error.
+func (srv *Server) SetErrorBody(p string) error {
+	e := &errorPolicy{Body: p}
+	err := e.parse()
+	if err != nil {
+		return fmt.Errorf("Couldn't set error body in *Server.SetErrorBody. %s", err.Error())
+	}
+
+	srv.errorPolicy.Body, srv.errorPolicy.body = e.Body, e.body
+	return nil
+}
+
+// SetSoftFailures sets if failures should be recorded as soft errors without stopping the job s.
+// Defaults to false, which stops the job at the first failure.
+func (srv *Server) SetSoftFailures(s bool) {
+	srv.errorPolicy.Soft = &s
+}
+
+// SetRedirectPolicy sets how the built-in client should handle redirects for all jobs. Mode m can be follow,
+// which follows up to 10 redirects, none which never follows redirects or max which follows up to n redirects.
+// Can be overridden per step by the redirect statement. Defaults to follow.
+// Returns error.
+func (srv *Server) SetRedirectPolicy(m string, n int) error {
+	r := redirectPolicy{Mode: strings.ToLower(m), Max: n}
+	err := r.parse()
+	if err != nil {
+		return fmt.Errorf("Couldn't set redirect policy in *Server.SetRedirectPolicy. %s", err.Error())
+	}
+
+	srv.redirectPolicy = r
+	return nil
+}
+
 // GetNumberOfVirtualUsers returns the number of virtual users.
 // Returns int.
 func (srv *Server) GetNumberOfVirtualUsers() int {
@@ -135,6 +207,16 @@ func (srv *Server) GetNumberOfErrors() int {
 	return errors
 }
 
+// GetNumberOfSoftErrors will return the amount of soft errors, which are failures that didn't stop the job.
+// Returns int.
+func (srv *Server) GetNumberOfSoftErrors() int {
+	errors := 0
+	for _, res := range srv.results {
+		errors += len(res.SoftErrors)
+	}
+	return errors
+}
+
 // GetErrorMessages will return all the errors since the Server was started.
 // Returns []*ResultError.
 func (srv *Server) GetErrorMessages() []*ResultError {
@@ -147,6 +229,18 @@ func (srv *Server) GetErrorMessages() []*ResultError {
 	return errors
 }
 
+// GetNumberOfExtractionMisses will return the amount of varfrom items that didn't match anything in all the steps.
+// Returns int.
+func (srv *Server) GetNumberOfExtractionMisses() int {
+	misses := 0
+	for _, res := range srv.results {
+		for _, step := range res.Steps {
+			misses += step.ExtractionMisses
+		}
+	}
+	return misses
+}
+
 // GetAverageFetchTime will return the average fetch time for all the requests. Requests that resulted in errors will be ignored in the average.
 // Returns time.Duration.
 func (srv *Server) GetAverageFetchTime() time.Duration {
@@ -167,6 +261,98 @@ func (srv *Server) GetAverageFetchTime() time.Duration {
 	return time.Duration(duration/numRequests) / time.Millisecond
 }
 
+// GetAverageTiming will return the average timing breakdown of all the steps that got a response.
+// DNS lookup, TCP connect and TLS handshake are only averaged over the steps that opened a new connection.
+// Returns ResultTiming.
+func (srv *Server) GetAverageTiming() ResultTiming {
+	sum, avg := ResultTiming{}, ResultTiming{}
+	steps, newConns := 0, 0
+
+	for _, res := range srv.results {
+		for _, step := range res.Steps {
+			if step.Status < 1 {
+				continue
+			}
+
+			steps++
+			sum.TimeToFirstByte += step.Timing.TimeToFirstByte
+			sum.ContentDownload += step.Timing.ContentDownload
+			sum.Total += step.Timing.Total
+
+			if !step.Timing.ConnectionReused {
+				newConns++
+				sum.DNSLookup += step.Timing.DNSLookup
+				sum.TCPConnect += step.Timing.TCPConnect
+				sum.TLSHandshake += step.Timing.TLSHandshake
+			}
+		}
+	}
+
+	if steps > 0 {
+		avg.TimeToFirstByte = sum.TimeToFirstByte / time.Duration(steps)
+		avg.ContentDownload = sum.ContentDownload / time.Duration(steps)
+		avg.Total = sum.Total / time.Duration(steps)
+	}
+
+	if newConns > 0 {
+		avg.DNSLookup = sum.DNSLookup / time.Duration(newConns)
+		avg.TCPConnect = sum.TCPConnect / time.Duration(newConns)
+		avg.TLSHandshake = sum.TLSHandshake / time.Duration(newConns)
+	}
+
+	return avg
+}
+
+// GetNumberOfReusedConnections will return the amount of steps that got a response on a reused connection.
+// Returns int.
+func (srv *Server) GetNumberOfReusedConnections() int {
+	reused := 0
+	for _, res := range srv.results {
+		for _, step := range res.Steps {
+			if step.Status > 0 && step.Timing.ConnectionReused {
+				reused++
+			}
+		}
+	}
+	return reused
+}
+
+// GetTotalBytesSent will return the total size of all request bodies sent, after any compression.
+// Returns int64.
+func (srv *Server) GetTotalBytesSent() int64 {
+	bytes := int64(0)
+	for _, res := range srv.results {
+		for _, step := range res.Steps {
+			bytes += step.BytesSent
+		}
+	}
+	return bytes
+}
+
+// GetTotalBytesReceived will return the total size of all response bodies as they were received, before they were decoded.
+// Returns int64.
+func (srv *Server) GetTotalBytesReceived() int64 {
+	bytes := int64(0)
+	for _, res := range srv.results {
+		for _, step := range res.Steps {
+			bytes += step.BytesReceived
+		}
+	}
+	return bytes
+}
+
+// GetTotalBytesDecoded will return the total size of all response bodies after they were decoded.
+// Returns int64.
+func (srv *Server) GetTotalBytesDecoded() int64 {
+	bytes := int64(0)
+	for _, res := range srv.results {
+		for _, step := range res.Steps {
+			bytes += step.BytesDecoded
+		}
+	}
+	return bytes
+}
+
 // IsRunning returns true if the Server is still running jobs. False if it has finished or manually been stopped.
 // Returns bool.
 func (srv *Server) IsRunning() bool {
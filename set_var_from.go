@@ -3,65 +3,226 @@ package steptest
 
 import (
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
-// variablesFrom will set variables from either BODY or HEADERS as defined in step s
-// from the response res and add them to the job j.
-// Returns error.
-func (j *job) variablesFrom(s *step, res *http.Response) error {
-	if len(s.varfrom) == 0 {
-		return nil
-	}
-
-	raw, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return fmt.Errorf("Couldn't read Body of response in *job.variablesFrom. %s", err.Error())
-	}
-	headers := res.Header
-
+// variablesFrom will set variables from either BODY, HEADER, STATUS, URL, LOCATION, COOKIE, TIME or JSON
+// as defined in step s from the response res and add them to the job j.
+// The already read body raw is used by the BODY source and duration d is the time it took to receive
+// the response which is used by the TIME source.
+// Any varfrom item that didn't match will be counted in s.varfromMisses. If the item has a default value
+// the variable will be set to it, and if it's required the step will fail with an excerpt of the body.
+// Returns *ResultError.
+func (j *job) variablesFrom(s *step, res *http.Response, raw *[]byte, d time.Duration) *ResultError {
 	for _, v := range s.varfrom {
+		found := true
+		var err error
+
 		switch strings.ToUpper(v.From) {
 		case "BODY":
-			err := j.variableFromBody(&v, &raw)
-			if err != nil {
-				return err
-			}
+			found, err = j.variableFromBody(&v, raw)
 
 		case "HEADER":
-			j.variableFromHeader(&v, headers)
+			found, err = j.variableFromHeader(&v, res.Header)
+
+		case "STATUS":
+			j.vars[v.Varname] = strconv.Itoa(res.StatusCode)
+
+		case "URL":
+			j.vars[v.Varname] = responseURL(s, res)
+
+		case "LOCATION":
+			found = j.variableFromLocation(&v, res)
+
+		case "COOKIE":
+			found = j.variableFromCookie(&v, res)
+
+		case "TIME":
+			j.vars[v.Varname] = strconv.FormatInt(int64(d/time.Millisecond), 10)
+
+		case "JSON":
+			found = j.variableFromJSON(&v, raw)
+		}
+
+		if err != nil {
+			return &ResultError{Error: err, URL: s.url, Status: res.StatusCode}
+		}
+
+		if found {
+			continue
+		}
+
+		s.varfromMisses++
+		switch {
+		case v.Required:
+			return &ResultError{
+				Error:  fmt.Errorf("Required varfrom %s from %s didn't match anything. %d %s %s", v.Varname, v.From, res.StatusCode, s.method, s.url),
+				URL:    s.url,
+				Status: res.StatusCode,
+				Body:   bodyExcerpt(*raw),
+			}
+
+		case v.Default != "":
+			j.vars[v.Varname] = v.Default
 		}
 	}
 
 	return nil
 }
 
+// responseURL returns the URL of the request the response res was received for, which is the final URL after any
+// redirects. Custom fetch functions might return responses without the request, and then the URL of step s is used.
+// Returns string.
+func responseURL(s *step, res *http.Response) string {
+	if res.Request == nil || res.Request.URL == nil {
+		return s.url
+	}
+	return res.Request.URL.String()
+}
+
+// bodyExcerpt returns the first bodyExcerptLength bytes of body b.
+// Returns string.
+func bodyExcerpt(b []byte) string {
+	if len(b) > bodyExcerptLength {
+		return string(b[:bodyExcerptLength])
+	}
+	return string(b)
+}
+
 // variableFromHeader will create or overwrite a variable in the jobs j vars map based on the
 // value stored in the response res headers of the header with name from v.orgSyntax.
-func (j *job) variableFromHeader(v *varfromItem, header http.Header) {
-	value := header.Get(v.OrgSyntax)
-	if value == "" {
-		return
+// If v.OrgSyntax contains the searchSyntax it will instead be used as a search pattern against the values
+// of the header named v.Header, or against all header values if v.Header is empty.
+// Returns true if the variable was set and error.
+func (j *job) variableFromHeader(v *varfromItem, header http.Header) (bool, error) {
+	if !strings.Contains(v.OrgSyntax, searchSyntax) {
+		value := header.Get(v.OrgSyntax)
+		if value == "" {
+			return false, nil
+		}
+
+		j.vars[v.Varname] = value
+		return true, nil
 	}
 
-	j.vars[v.Varname] = value
+	values := []string{}
+	switch {
+	case v.Header != "":
+		values = header[http.CanonicalHeaderKey(v.Header)]
+
+	default:
+		for _, hv := range header {
+			values = append(values, hv...)
+		}
+	}
+
+	for _, hv := range values {
+		raw := []byte(hv)
+		value, err := j.findSearchPattern(v, &raw)
+		if err != nil {
+			return false, err
+		}
+
+		if value != "" {
+			j.vars[v.Varname] = value
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
 
 // variableFromBody will create or overwrite a variable in the jobs j vars map based on the
 // search syntax supplied by v.syntax.
-// Returns error.
-func (j *job) variableFromBody(v *varfromItem, raw *[]byte) error {
+// Returns true if the variable was set and error.
+func (j *job) variableFromBody(v *varfromItem, raw *[]byte) (bool, error) {
+	value, err := j.findSearchPattern(v, raw)
+	if err != nil {
+		return false, err
+	}
+
+	if value == "" {
+		return false, nil
+	}
+
+	j.vars[v.Varname] = value
+	return true, nil
+}
+
+// variableFromJSON will create or overwrite a variable in the jobs j vars map with the value at the
+// JSON path v.OrgSyntax in the body raw, such as data.cart.id for GraphQL responses. Strings are used
+// as is and anything else as compact JSON. Missing paths, null values and bodies that aren't JSON don't match.
+// Returns true if the variable was set.
+func (j *job) variableFromJSON(v *varfromItem, raw *[]byte) bool {
+	doc, err := decodeJSON(*raw)
+	if err != nil {
+		return false
+	}
+
+	value, ok := jsonPathLookup(doc, v.OrgSyntax)
+	if !ok || value == nil {
+		return false
+	}
+
+	j.vars[v.Varname] = jsonValueString(value)
+	return true
+}
+
+// variableFromLocation will create or overwrite a variable in the jobs j vars map with the Location header of the
+// response res. If the redirect was already followed the Location of the last redirect response will be used.
+// Returns true if the variable was set.
+func (j *job) variableFromLocation(v *varfromItem, res *http.Response) bool {
+	for r := res; r != nil; r = r.Request.Response {
+		if location := r.Header.Get("Location"); location != "" {
+			j.vars[v.Varname] = location
+			return true
+		}
+
+		if r.Request == nil {
+			break
+		}
+	}
+
+	return false
+}
+
+// variableFromCookie will create or overwrite a variable in the jobs j vars map with the value of the cookie
+// named v.OrgSyntax set by the response res. Cookies set by any followed redirect responses will also be searched,
+// the latest response taking precedence.
+// Returns true if the variable was set.
+func (j *job) variableFromCookie(v *varfromItem, res *http.Response) bool {
+	for r := res; r != nil; r = r.Request.Response {
+		for _, c := range r.Cookies() {
+			if c.Name == v.OrgSyntax {
+				j.vars[v.Varname] = c.Value
+				return true
+			}
+		}
+
+		if r.Request == nil {
+			break
+		}
+	}
+
+	return false
+}
+
+// findSearchPattern will search raw for the search syntax supplied by v.Syntax and strip away
+// everything that isn't part of the searchSyntax placeholder. If nothing was found the returned value is empty.
+// Returns string and error.
+func (*job) findSearchPattern(v *varfromItem, raw *[]byte) (string, error) {
 	regexp, err := regexp.Compile(v.Syntax)
 	if err != nil {
-		return fmt.Errorf("Couldn't compile regular expression in *job.variableFromBody. %s", err.Error())
+		return "", fmt.Errorf("Couldn't compile regular expression in *job.findSearchPattern. %s", err.Error())
 	}
 
 	value := string(regexp.Find(*raw))
 	if value == "" {
-		return nil
+		return "", nil
 	}
 
 	parts := strings.Split(v.OrgSyntax, searchSyntax)
@@ -69,6 +230,5 @@ func (j *job) variableFromBody(v *varfromItem, raw *[]byte) error {
 		value = strings.Replace(value, part, "", -1)
 	}
 
-	j.vars[v.Varname] = value
-	return nil
+	return value, nil
 }
@@ -0,0 +1,150 @@
+package steptest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVariablesFrom(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc123"})
+			http.Redirect(w, r, "/account", http.StatusFound)
+
+		default:
+			w.Header().Set("Link", "</cart?page=2>; rel=\"next\"")
+			w.Write([]byte(`<input name="token" value="tok1" />`))
+		}
+	}))
+	defer ts.Close()
+
+	j := &job{vars: make(map[string]string)}
+	s := &step{method: "GET", url: ts.URL + "/login"}
+
+	for _, raw := range []string{
+		`{ "from": "status", "name": "status" }`,
+		`{ "from": "url", "name": "url" }`,
+		`{ "from": "location", "name": "location" }`,
+		`{ "from": "cookie", "name": "session", "find": "session" }`,
+		`{ "from": "time", "name": "time" }`,
+		`{ "from": "header", "name": "next", "header": "Link", "find": "<{{StepTestSyntax}}>" }`,
+		`{ "from": "body", "name": "token", "find": "value=\"{{StepTestSyntax}}\"" }`,
+	} {
+		if err := createVarFrom(j, s, &raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status, resErr := j.fetchStep(http.DefaultClient.Do, s)
+	if resErr != nil {
+		t.Fatal(resErr.Error)
+	}
+
+	expected := map[string]string{
+		"status":   "200",
+		"url":      ts.URL + "/account",
+		"location": "/account",
+		"session":  "abc123",
+		"next":     "/cart?page=2",
+		"token":    "tok1",
+	}
+	for name, value := range expected {
+		if j.vars[name] != value {
+			t.Errorf("Expected var %s to be %s but got %s", name, value, j.vars[name])
+		}
+	}
+
+	if status != 200 {
+		t.Errorf("Expected status to be %d but got %d", 200, status)
+	}
+
+	if _, ok := j.vars["time"]; !ok {
+		t.Errorf("Expected var time to be set")
+	}
+}
+
+func TestCreateVarFromInvalid(t *testing.T) {
+	j := &job{vars: make(map[string]string)}
+	s := &step{}
+
+	for _, raw := range []string{
+		`{ "from": "nowhere", "name": "var1", "find": "x" }`,
+		`{ "from": "cookie", "name": "var1" }`,
+	} {
+		if err := createVarFrom(j, s, &raw); err == nil {
+			t.Errorf("Expected error for varfrom %s but got nil", raw)
+		}
+	}
+}
+
+func TestVariablesFromMisses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>Out of stock</html>"))
+	}))
+	defer ts.Close()
+
+	j := &job{vars: make(map[string]string)}
+	s := &step{method: "GET", url: ts.URL}
+
+	for _, raw := range []string{
+		`{ "from": "body", "name": "token", "find": "value=\"{{StepTestSyntax}}\"", "default": "none" }`,
+		`{ "from": "cookie", "name": "session", "find": "session" }`,
+	} {
+		if err := createVarFrom(j, s, &raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, resErr := j.fetchStep(http.DefaultClient.Do, s)
+	if resErr != nil {
+		t.Fatal(resErr.Error)
+	}
+
+	if j.vars["token"] != "none" {
+		t.Errorf("Expected var token to be %s but got %s", "none", j.vars["token"])
+	}
+
+	if s.varfromMisses != 2 {
+		t.Errorf("Expected %d extraction misses but got %d", 2, s.varfromMisses)
+	}
+
+	required := `{ "from": "header", "name": "cart", "find": "X-Cart-Id", "required": true }`
+	s = &step{method: "GET", url: ts.URL}
+	if err := createVarFrom(j, s, &required); err != nil {
+		t.Fatal(err)
+	}
+
+	_, resErr = j.fetchStep(http.DefaultClient.Do, s)
+	if resErr == nil {
+		t.Fatal("Expected required varfrom to result in an error but got nil")
+	}
+
+	if resErr.Body != "<html>Out of stock</html>" {
+		t.Errorf("Expected error body to be %s but got %s", "<html>Out of stock</html>", resErr.Body)
+	}
+}
+
+func TestVariablesFromWithoutRequest(t *testing.T) {
+	// Custom fetch functions might return a response without the request it was received for.
+	fetch := func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Header: http.Header{"Set-Cookie": {"session=abc"}}, Body: http.NoBody}, nil
+	}
+
+	j := &job{vars: make(map[string]string)}
+	s := &step{method: "GET", url: "http://example.com/cart"}
+
+	raw := `{ "from": "url", "name": "url" }`
+	if err := createVarFrom(j, s, &raw); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, resErr := j.fetchStep(fetch, s); resErr != nil {
+		t.Fatal(resErr.Error)
+	}
+
+	if j.vars["url"] != "http://example.com/cart" || s.finalURL != "http://example.com/cart" {
+		t.Errorf("Expected the URL of the step as fallback but got %s and %s", j.vars["url"], s.finalURL)
+	}
+}
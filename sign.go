@@ -0,0 +1,306 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	amzDateFormat     = "20060102T150405Z" // amzDateFormat is the format of the X-Amz-Date header.
+	defaultHMACHeader = "X-Signature"      // defaultHMACHeader is the header the HMAC signature is set in if no header was supplied.
+)
+
+var (
+	// Allowed types for the sign and @sign statements.
+	allowedSigningTypes = []string{"aws", "hmac"}
+
+	// Allowed algorithms for HMAC signing.
+	allowedHMACAlgorithms = map[string]func() hash.Hash{
+		"sha1":   sha1.New,
+		"sha256": sha256.New,
+		"sha512": sha512.New,
+	}
+)
+
+// signing contains how requests should be signed.
+type signing struct {
+	Type string `json:"type"`
+
+	// AWS Signature Version 4.
+	Service      string `json:"service"`
+	Region       string `json:"region"`
+	AccessKey    string `json:"accessKey"`
+	SecretKey    string `json:"secretKey"`
+	SessionToken string `json:"sessionToken"`
+
+	// HMAC.
+	Secret          string `json:"secret"`
+	Header          string `json:"header"`
+	Algorithm       string `json:"algorithm"`
+	Encoding        string `json:"encoding"`
+	Prefix          string `json:"prefix"`
+	TimestampHeader string `json:"timestampHeader"`
+}
+
+// parse will validate the signing g and set any default values.
+// Returns error.
+func (g *signing) parse() error {
+	g.Type = strings.ToLower(g.Type)
+
+	switch g.Type {
+	case "aws":
+		switch {
+		case g.Service == "":
+			return fmt.Errorf("SERVICE was not supplied")
+
+		case g.Region == "":
+			return fmt.Errorf("REGION was not supplied")
+		}
+
+	case "hmac":
+		if g.Secret == "" {
+			return fmt.Errorf("SECRET was not supplied")
+		}
+
+		if g.Header == "" {
+			g.Header = defaultHMACHeader
+		}
+
+		g.Algorithm = strings.ToLower(g.Algorithm)
+		if g.Algorithm == "" {
+			g.Algorithm = "sha256"
+		}
+
+		if _, ok := allowedHMACAlgorithms[g.Algorithm]; !ok {
+			return fmt.Errorf("ALGORITHM %s is not supported. Supported algorithms are sha1, sha256 and sha512", g.Algorithm)
+		}
+
+		g.Encoding = strings.ToLower(g.Encoding)
+		if g.Encoding == "" {
+			g.Encoding = "hex"
+		}
+
+		if g.Encoding != "hex" && g.Encoding != "base64" {
+			return fmt.Errorf("ENCODING %s is not supported. Supported encodings are hex and base64", g.Encoding)
+		}
+
+	default:
+		return fmt.Errorf("TYPE %s is not supported. Supported types are %s", g.Type, allowedSigningTypes)
+	}
+
+	return nil
+}
+
+// signingFor will return the signing to use for step s with any variables replaced. The steps signing takes precedence over the jobs j global signing.
+// AWS credentials that aren't supplied are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+// Returns signing.
+func (j *job) signingFor(s *step) signing {
+	g := j.globalSigning
+	if s.signing.Type != "" {
+		g = s.signing
+	}
+
+	g.AccessKey = j.replaceVariables(g.AccessKey)
+	g.SecretKey = j.replaceVariables(g.SecretKey)
+	g.SessionToken = j.replaceVariables(g.SessionToken)
+	g.Secret = j.replaceVariables(g.Secret)
+
+	if g.Type == "aws" && g.AccessKey == "" && g.SecretKey == "" {
+		g.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		g.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if g.SessionToken == "" {
+			g.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		}
+	}
+
+	return g
+}
+
+// signRequest will sign the request req for step s with the body body. Should be called after all variables
+// have been replaced and all headers have been added, since the signature covers them.
+// The body is read from a new reader, so streamed bodies are never buffered.
+// Returns error.
+func (j *job) signRequest(s *step, req *http.Request, body *requestBody) error {
+	g := j.signingFor(s)
+	if g.Type == "" {
+		return nil
+	}
+
+	if g.Type == "aws" && (g.AccessKey == "" || g.SecretKey == "") {
+		return fmt.Errorf("Couldn't find AWS credentials for signing in the sign statement or the environment")
+	}
+
+	r, err := body.open()
+	if err != nil {
+		return fmt.Errorf("Couldn't open the body for signing. %s", err.Error())
+	}
+	defer r.Close()
+
+	switch g.Type {
+	case "aws":
+		err = g.signAWS(req, r, time.Now())
+
+	case "hmac":
+		err = g.signHMAC(req, r, time.Now())
+	}
+
+	if err != nil {
+		return fmt.Errorf("Couldn't read the body for signing. %s", err.Error())
+	}
+	return nil
+}
+
+// signHMAC will sign the request req with body body at time t using HMAC. The signed string is the method, the path
+// with query, the timestamp if a timestamp header is used, and the body separated by newlines.
+// Returns error.
+func (g *signing) signHMAC(req *http.Request, body io.Reader, t time.Time) error {
+	parts := []string{req.Method, req.URL.RequestURI()}
+	if g.TimestampHeader != "" {
+		timestamp := strconv.FormatInt(t.Unix(), 10)
+		req.Header.Set(g.TimestampHeader, timestamp)
+		parts = append(parts, timestamp)
+	}
+	parts = append(parts, "")
+
+	mac := hmac.New(allowedHMACAlgorithms[g.Algorithm], []byte(g.Secret))
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	if body != nil {
+		if _, err := io.Copy(mac, body); err != nil {
+			return err
+		}
+	}
+
+	signature := hex.EncodeToString(mac.Sum(nil))
+	if g.Encoding == "base64" {
+		signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	req.Header.Set(g.Header, g.Prefix+signature)
+	return nil
+}
+
+// signAWS will sign the request req with body body at time t using AWS Signature Version 4.
+// The signed headers are Host, X-Amz-Date and X-Amz-Security-Token when a session token is used.
+// For S3 the X-Amz-Content-Sha256 header is also set and signed.
+// Returns error.
+func (g *signing) signAWS(req *http.Request, body io.Reader, t time.Time) error {
+	amzDate := t.UTC().Format(amzDateFormat)
+	date := amzDate[:8]
+
+	payload := sha256.New()
+	if body != nil {
+		if _, err := io.Copy(payload, body); err != nil {
+			return err
+		}
+	}
+	payloadHash := hex.EncodeToString(payload.Sum(nil))
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if g.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", g.SessionToken)
+	}
+	if g.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for _, name := range []string{"X-Amz-Date", "X-Amz-Security-Token", "X-Amz-Content-Sha256"} {
+		if value := req.Header.Get(name); value != "" {
+			headers[strings.ToLower(name)] = strings.Trim(value, trim)
+		}
+	}
+
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{req.Method, awsCanonicalURI(req.URL, g.Service), awsCanonicalQuery(req.URL.Query()), canonicalHeaders, signedHeaders, payloadHash}, "\n")
+	scope := strings.Join([]string{date, g.Region, g.Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+g.SecretKey), date)
+	for _, part := range []string{g.Region, g.Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", g.AccessKey, scope, signedHeaders, signature))
+	return nil
+}
+
+// awsCanonicalURI will return the canonical URI of URL u as defined by AWS Signature Version 4. Every segment of the
+// already escaped path is URI encoded once more, except for S3 which uses the path as it was sent.
+// Returns string.
+func awsCanonicalURI(u *url.URL, service string) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+
+	if service == "s3" {
+		return path
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// awsCanonicalQuery will return the canonical query string of query q as defined by AWS Signature Version 4.
+// Returns string.
+func awsCanonicalQuery(q url.Values) string {
+	params := []string{}
+	for key, values := range q {
+		for _, value := range values {
+			params = append(params, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// awsEscape will URI encode string str as defined by AWS Signature Version 4.
+// Returns string.
+func awsEscape(str string) string {
+	return strings.Replace(strings.Replace(url.QueryEscape(str), "+", "%20", -1), "%7E", "~", -1)
+}
+
+// sha256Hex returns the hex encoded SHA256 hash of b.
+// Returns string.
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// hmacSHA256 returns the HMAC SHA256 of data using key.
+// Returns []byte.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
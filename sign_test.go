@@ -0,0 +1,113 @@
+package steptest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAWS(t *testing.T) {
+	// Examples from the AWS Signature Version 4 test suite.
+	for _, test := range []struct {
+		url       string
+		signature string
+	}{
+		{"https://example.amazonaws.com/", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"https://example.amazonaws.com/?Param2=value2&Param1=value1", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+	} {
+		req, _ := http.NewRequest("GET", test.url, nil)
+		g := &signing{Type: "aws", Service: "service", Region: "us-east-1", AccessKey: "AKIDEXAMPLE", SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+		g.signAWS(req, nil, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+		expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=" + test.signature
+		if auth := req.Header.Get("Authorization"); auth != expected {
+			t.Errorf("Expected Authorization %s but got %s", expected, auth)
+		}
+	}
+}
+
+func TestAWSCanonicalURI(t *testing.T) {
+	for _, test := range []struct {
+		url      string
+		service  string
+		expected string
+	}{
+		{"https://example.amazonaws.com", "execute-api", "/"},
+		{"https://example.amazonaws.com/documents and settings/", "execute-api", "/documents%2520and%2520settings/"},
+		{"https://example.amazonaws.com/documents and settings/", "s3", "/documents%20and%20settings/"},
+		{"https://example.amazonaws.com/a~b/c%2Fd", "lambda", "/a~b/c%252Fd"},
+	} {
+		u, _ := url.Parse(test.url)
+		if uri := awsCanonicalURI(u, test.service); uri != test.expected {
+			t.Errorf("Expected canonical URI %s for %s but got %s", test.expected, test.service, uri)
+		}
+	}
+}
+
+func TestSignStatement(t *testing.T) {
+	var received []*http.Request
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, string(body))
+	}))
+	defer ts.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secretenv")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	srv, _ := New(1, 5000, nil)
+
+	steps := "- var { \"name\": \"id\", \"value\": \"42\" }\n"
+	steps += "- @sign { \"type\": \"hmac\", \"secret\": \"s3cret\", \"header\": \"X-Hub-Signature\", \"prefix\": \"sha256=\", \"encoding\": \"base64\", \"timestampHeader\": \"X-Timestamp\" }\n"
+	steps += "- post " + ts.URL + "/items/{{id}}?a=b {\"id\":\"{{id}}\"}\n"
+	steps += "- get " + ts.URL + "/aws\n"
+	steps += "  sign { \"type\": \"aws\", \"service\": \"execute-api\", \"region\": \"eu-west-1\" }\n"
+
+	j, err := srv.parseJob(&rawJob{steps: steps})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	// The HMAC should be calculated after the variables were replaced.
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("POST\n/items/42?a=b\n" + received[0].Header.Get("X-Timestamp") + "\n" + bodies[0]))
+	expected := "sha256=" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	if bodies[0] != "{\"id\":\"42\"}" || received[0].Header.Get("X-Hub-Signature") != expected {
+		t.Errorf("Expected X-Hub-Signature %s but got %s", expected, received[0].Header.Get("X-Hub-Signature"))
+	}
+
+	// The steps sign statement takes precedence, with credentials from the environment.
+	if auth := received[1].Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDENV/") || !strings.Contains(auth, "/eu-west-1/execute-api/aws4_request") {
+		t.Errorf("Expected AWS signature with credentials from the environment but got %s", auth)
+	}
+
+	if sig := received[1].Header.Get("X-Hub-Signature"); sig != "" {
+		t.Errorf("Expected no HMAC signature on the AWS signed step but got %s", sig)
+	}
+
+	for _, a := range []string{
+		"{ \"type\": \"aws\", \"region\": \"eu-west-1\" }",
+		"{ \"type\": \"hmac\" }",
+		"{ \"type\": \"hmac\", \"secret\": \"s\", \"algorithm\": \"md5\" }",
+		"{ \"type\": \"jwt\" }",
+	} {
+		if _, err := srv.parseJob(&rawJob{steps: "- @sign " + a + "\n"}); err == nil {
+			t.Errorf("Expected error for invalid sign %s but got nil", a)
+		}
+	}
+}
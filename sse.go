@@ -0,0 +1,262 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptrace"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	sseDefaultTimeout = 10000            // sseDefaultTimeout is the timeout in milliseconds of sse if no timeout was supplied.
+	sseMaxLineSize    = 16 * 1024 * 1024 // sseMaxLineSize is the max size of a line in the event stream.
+)
+
+// sseMatch contains the event to wait for in a sse step. An event matches if it's of type event and its data
+// matches pattern, where an empty event or pattern matches any. Fails if no event matched within timeout milliseconds.
+type sseMatch struct {
+	Event   string `json:"event"`
+	Pattern string `json:"pattern"`
+	Timeout int    `json:"timeout"`
+}
+
+// ResultSSE contains the result of a sse step. Event and Data are the type and data of the matched event.
+// TimeToFirstEvent is the time from the request being sent until the first event was received, and EventsReceived
+// is the number of events received until one matched.
+type ResultSSE struct {
+	Event            string        `json:"event"`
+	Data             string        `json:"data"`
+	TimeToFirstEvent time.Duration `json:"timeToFirstEvent"`
+	EventsReceived   int           `json:"eventsReceived"`
+}
+
+// sseEvent is an event read from an event stream.
+type sseEvent struct {
+	event string
+	data  []byte
+}
+
+// createSSE will create a sse step based on step s and args a, which is the URL followed by an optional
+// JSON object with the event, pattern and timeout to wait for. Without it the first event matches.
+// Returns error.
+func createSSE(j *job, s *step, a *string) error {
+	v := strings.SplitN(strings.Trim(*a, trim), separator, 2)
+	sse := new(sseMatch)
+
+	switch {
+	case v[0] == "":
+		return fmt.Errorf("sse was declared but URL was not supplied in createSSE. Raw %s", *a)
+
+	case !strings.HasPrefix(v[0], "http://") && !strings.HasPrefix(v[0], "https://") && !strings.HasPrefix(v[0], "{{"):
+		return fmt.Errorf("sse was declared but the URL isn't http:// or https:// in createSSE. Raw %s", *a)
+	}
+
+	if len(v) > 1 {
+		err := json.Unmarshal([]byte(v[1]), sse)
+		if err != nil {
+			return fmt.Errorf("sse was declared but we couldn't unmarshal it in createSSE. Raw %s", *a)
+		}
+	}
+
+	switch {
+	case sse.Timeout < 0:
+		return fmt.Errorf("sse was declared but TIMEOUT is negative in createSSE. Raw %s", *a)
+
+	case sse.Pattern != "" && !strings.Contains(sse.Pattern, "{{"):
+		if _, err := regexp.Compile(sse.Pattern); err != nil {
+			return fmt.Errorf("sse was declared but PATTERN is invalid in createSSE. %s. Raw %s", err.Error(), *a)
+		}
+	}
+
+	if sse.Timeout == 0 {
+		sse.Timeout = sseDefaultTimeout
+	}
+
+	s.method = "SSE"
+	s.url = v[0]
+	s.sse = sse
+	return nil
+}
+
+// sseStep will open the event stream at the URL of step s with the headers, cookies and auth of the job and read
+// events until one matches, or fail if none did within the timeout. The stream is closed when the step ends.
+// The data of the matched event is used as the body by any varfrom and expect statements of step s.
+// The stream is also limited by the timeout of the Server. The timing of the step is stored in s.timing.
+// Which transport errors, including the timeout and the stream being closed, that results in an error is decided by the error policy.
+// Returns int and *ResultError.
+func (j *job) sseStep(c func(*http.Request) (*http.Response, error), s *step) (int, *ResultError) {
+	if !j.checkConditions(s) {
+		return 0, nil
+	}
+
+	j.replaceFromVariables(s)
+	policy := j.errorPolicy(s)
+	s.sseResult = &ResultSSE{}
+
+	pattern, err := regexp.Compile(j.replaceVariables(s.sse.Pattern))
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("Couldn't compile regular expression in *job.sseStep. %s", err.Error()), URL: s.url, Status: -1}
+	}
+	event := j.replaceVariables(s.sse.Event)
+
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("Error creating up the Request in *job.sseStep. %s", err)}
+	}
+
+	err = j.addAuth(c, s, req)
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("Couldn't add auth to the Request in *job.sseStep. %s", err.Error()), URL: s.url, Status: -1}
+	}
+	j.addOptions(s, req)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	err = j.runHooks(s.beforeRequest, &StepContext{Request: req, j: j})
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("BeforeRequest hook failed in *job.sseStep. %s", err.Error()), URL: s.url, Status: -1}
+	}
+	req, _ = j.withRequestContext(s, req)
+
+	timeout := time.Duration(s.sse.Timeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+
+	timer := newStepTimer()
+	req = req.WithContext(httptrace.WithClientTrace(ctx, timer.trace()))
+	res, err := c(req)
+	if err != nil {
+		s.timing = timer.done()
+		if !policy.isTransportError(err) {
+			return -1, nil
+		}
+		return -1, &ResultError{Error: fmt.Errorf("Error sending the Request in *job.sseStep. %s", err), URL: s.url, Status: -1}
+	}
+
+	wire := &countingBody{ReadCloser: res.Body}
+	defer func() {
+		res.Body.Close()
+		s.timing = timer.done()
+		s.bytesReceived = wire.n
+	}()
+
+	s.finalURL = responseURL(s, res)
+	s.responseProtocol = res.Proto
+
+	if !s.expectsStatus() && policy.isErrorStatus(res.StatusCode) {
+		body := j.readErrorBody(wire, j.responseMode(s))
+		return res.StatusCode, &ResultError{Error: fmt.Errorf("%d %s %s", res.StatusCode, s.method, s.url), URL: s.url, Status: res.StatusCode, Body: string(body)}
+	}
+
+	j.storeResponseCookies(res)
+
+	if t, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); t != "text/event-stream" {
+		return res.StatusCode, &ResultError{Error: fmt.Errorf("%d %s %s Content-Type %s isn't text/event-stream", res.StatusCode, s.method, s.url, t), URL: s.url, Status: res.StatusCode, Body: string(j.readErrorBody(wire, responseMode{}))}
+	}
+
+	scanner := bufio.NewScanner(wire)
+	scanner.Buffer(make([]byte, 4096), sseMaxLineSize)
+	for {
+		e, err := readSSEEvent(scanner)
+		if err != nil {
+			switch {
+			case classifyTransportError(err) == "timeout":
+				err = fmt.Errorf("No event matched within %d ms. %w", s.sse.Timeout, err)
+
+			case errors.Is(err, errSSEClosed):
+				err = fmt.Errorf("The stream was closed before an event matched. %w", err)
+			}
+
+			if !policy.isTransportError(err) {
+				return res.StatusCode, nil
+			}
+			return res.StatusCode, &ResultError{Error: fmt.Errorf("sse failed in *job.sseStep. %w", err), URL: s.url, Status: res.StatusCode}
+		}
+
+		if s.sseResult.EventsReceived == 0 {
+			s.sseResult.TimeToFirstEvent = time.Now().Sub(timer.start)
+		}
+		s.sseResult.EventsReceived++
+
+		if (event != "" && e.event != event) || !pattern.Match(e.data) {
+			continue
+		}
+
+		d := time.Now().Sub(timer.start)
+		s.sseResult.Event = e.event
+		s.sseResult.Data = string(e.data)
+
+		resErr := j.checkExpectations(s, res, &e.data, d)
+		if resErr != nil {
+			return res.StatusCode, resErr
+		}
+
+		resErr = j.variablesFrom(s, res, &e.data, d)
+		if resErr != nil {
+			return res.StatusCode, resErr
+		}
+
+		err = j.runHooks(s.afterResponse, &StepContext{Request: res.Request, Response: res, Body: e.data, j: j})
+		if err != nil {
+			return res.StatusCode, &ResultError{Error: fmt.Errorf("AfterResponse hook failed in *job.sseStep. %s", err.Error()), URL: s.url, Status: res.StatusCode, Body: bodyExcerpt(e.data)}
+		}
+		return res.StatusCode, nil
+	}
+}
+
+// errSSEClosed is returned by readSSEEvent if the stream ended. It wraps io.EOF so that error policies see it as reset.
+var errSSEClosed = fmt.Errorf("event stream closed. %w", io.EOF)
+
+// readSSEEvent will read lines from the event stream scanner until an event with data was dispatched by an empty line.
+// Data lines are joined by newlines, the event type defaults to message and comments, id and retry fields are ignored.
+// Returns sseEvent and error.
+func readSSEEvent(scanner *bufio.Scanner) (sseEvent, error) {
+	e := sseEvent{}
+	hasData := false
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if !hasData {
+				e = sseEvent{}
+				continue
+			}
+
+			if e.event == "" {
+				e.event = "message"
+			}
+			return e, nil
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i != -1 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "event":
+			e.event = value
+
+		case "data":
+			if hasData {
+				e.data = append(e.data, '\n')
+			}
+			e.data = append(e.data, value...)
+			hasData = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return e, err
+	}
+	return e, errSSEClosed
+}
@@ -0,0 +1,151 @@
+package steptest
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// orderStream returns a handler streaming the status events of the order in the query, first pending and
+// then shipped. /plain isn't an event stream and /closed ends the stream after the pending event.
+// Whether the stream was closed by the client within 2 seconds is sent on closed.
+func orderStream(closed chan bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/plain" {
+			w.Write([]byte("not a stream"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		w.Write([]byte(": connected\n\nretry: 1000\n\n"))
+		w.Write([]byte("event: status\ndata: {\"order\":\"" + r.URL.Query().Get("order") + "\",\ndata: \"state\":\"pending\"}\n\n"))
+		w.(http.Flusher).Flush()
+
+		if r.URL.Path == "/closed" {
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("data: keep-alive\n\n"))
+		w.Write([]byte("event: status\ndata: {\"state\":\"shipped\",\"tracking\":\"T1\"}\n\n"))
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-r.Context().Done():
+			closed <- true
+		case <-time.After(2 * time.Second):
+			closed <- false
+		}
+	}
+}
+
+func TestSSE(t *testing.T) {
+	closed := make(chan bool, 1)
+	ts := newTestServer(t, orderStream(closed))
+
+	srv, _ := New(1, 5000, nil)
+
+	steps := "- var { \"name\": \"state\", \"value\": \"shipped\" }\n"
+	steps += "- sse " + ts.URL + "/orders?order=o1 { \"event\": \"status\", \"pattern\": \"\\\"state\\\":\\\"{{state}}\\\"\", \"timeout\": 2000 }\n"
+	steps += "  varfrom { \"from\": \"json\", \"name\": \"tracking\", \"find\": \"tracking\" }\n"
+
+	j, err := srv.parseJob(&rawJob{steps: steps})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	if accept := ts.requests()[0].Header.Get("Accept"); j.vars["tracking"] != "T1" || accept != "text/event-stream" {
+		t.Errorf("Expected tracking T1 from the event data with Accept text/event-stream but got %s and %s", j.vars["tracking"], accept)
+	}
+
+	// The pending and keep-alive events don't match but are counted, comments and retry aren't events.
+	res := r.Steps[1].SSE
+	if res.EventsReceived != 3 || res.Event != "status" || res.TimeToFirstEvent == 0 || res.TimeToFirstEvent > r.Steps[1].Duration {
+		t.Errorf("Expected 3 events received with the time to the first event but got %d and %s", res.EventsReceived, res.TimeToFirstEvent)
+	}
+
+	if !<-closed {
+		t.Errorf("Expected the stream to be closed when the step ended")
+	}
+}
+
+func TestSSEFirstEvent(t *testing.T) {
+	closed := make(chan bool, 1)
+	ts := newTestServer(t, orderStream(closed))
+
+	srv, _ := New(1, 5000, nil)
+
+	// Data lines are joined by newlines, and without event or pattern the first event matches.
+	j, _ := srv.parseJob(&rawJob{steps: "- sse " + ts.URL + "?order=o2\n  expect { \"type\": \"contains\", \"value\": \"\\\"o2\\\",\\n\\\"state\\\"\" }\n"})
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil || r.Steps[0].SSE.EventsReceived != 1 {
+		t.Errorf("Expected the first event to match but got %v", r.Err)
+	}
+	<-closed
+}
+
+func TestSSEErrors(t *testing.T) {
+	closed := make(chan bool, 1)
+	ts := newTestServer(t, orderStream(closed))
+
+	srv, _ := New(1, 5000, nil)
+	cancelled := " { \"event\": \"cancelled\", \"timeout\": 100 }\n"
+
+	for _, test := range []struct {
+		name   string
+		steps  string
+		err    string
+		soft   bool
+		closed bool
+	}{
+		{"timeout", "- sse " + ts.URL + cancelled, "within 100 ms", false, true},
+		{"soft timeout", "- sse " + ts.URL + cancelled + "  errors { \"soft\": true }\n", "within 100 ms", true, true},
+		{"ignored timeout", "- sse " + ts.URL + cancelled + "  errors { \"transport\": [ \"refused\" ] }\n", "", false, true},
+		{"closed", "- sse " + ts.URL + "/closed" + cancelled, "closed before an event matched", false, false},
+		{"ignored closed", "- sse " + ts.URL + "/closed" + cancelled + "  errors { \"transport\": [ \"timeout\" ] }\n", "", false, false},
+		{"not a stream", "- sse " + ts.URL + "/plain\n", "isn't text/event-stream", false, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			j, err := srv.parseJob(&rawJob{steps: test.steps})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := srv.fetchJob(j, srv.fetchFunc)
+			if test.closed {
+				<-closed
+			}
+
+			errs := r.SoftErrors
+			if r.Err != nil {
+				errs = append(errs, r.Err)
+			}
+
+			switch {
+			case test.err == "" && len(errs) > 0:
+				t.Errorf("Expected no error but got %s", errs[0].Error)
+
+			case test.err != "" && (len(errs) != 1 || !strings.Contains(errs[0].Error.Error(), test.err)):
+				t.Errorf("Expected an error containing %q but got %v", test.err, errs)
+
+			case test.err != "" && errs[0].Soft != test.soft:
+				t.Errorf("Expected soft to be %t but got %t", test.soft, errs[0].Soft)
+			}
+		})
+	}
+}
+
+func TestCreateSSE(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+
+	for _, a := range []string{"", "ws://example.com", "http://example.com { \"pattern\": \"(\" }", "http://example.com { \"timeout\": -1 }", "http://example.com event"} {
+		if _, err := srv.parseJob(&rawJob{steps: "- sse " + a + "\n"}); err == nil {
+			t.Errorf("Expected error for invalid sse %s but got nil", a)
+		}
+	}
+}
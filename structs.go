@@ -2,9 +2,14 @@
 package steptest
 
 import (
+	"crypto/tls"
 	"net/http"
+	"net/http/cookiejar"
+	"regexp"
 	"sync"
 	"time"
+
+	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
 // Server contains the necessary functions and data to run StepTest.
@@ -13,6 +18,34 @@ type Server struct {
 	fetchWorkers int
 	fetchFunc    func(*http.Request) (*http.Response, error)
 
+	customFetch      bool
+	timeout          time.Duration
+	clients          *clientSet
+	connectionModel  string
+	protocol         string
+	proxy            string
+	profiles         map[string]int
+	resolve          map[string]string
+	network          networkShape
+	tokens           *tokenCache
+	transportOptions TransportOptions
+
+	// TLS settings of the built-in client. Loaded configs are cached by their options.
+	tlsOptions TLSOptions
+	tlsConfig  *tls.Config
+	tlsConfigs map[string]*tls.Config
+	tlsMu      sync.Mutex
+
+	// Descriptor sets by file name and descriptors loaded with server reflection by service, and the gRPC connections
+	// shared by all virtual users.
+	descriptorSets map[string]*protoregistry.Files
+	grpcReflected  map[string]*protoregistry.Files
+	descriptorMu   sync.Mutex
+	grpcConns      *grpcConnSet
+
+	// Custom step types registered by RegisterStepType.
+	stepTypes map[string]StepFunc
+
 	startTime time.Time
 	endTime   time.Time
 
@@ -26,6 +59,10 @@ type Server struct {
 	resultsCounter    int
 	resultCounterChan chan int
 
+	errorPolicy    errorPolicy
+	redirectPolicy redirectPolicy
+	responseMode   responseMode
+
 	stopping bool
 	running  bool
 	wgRun    sync.WaitGroup
@@ -38,12 +75,57 @@ type rawJob struct {
 }
 
 type job struct {
-	steps         []step
-	vars          map[string]string
-	arrays        map[string][]string
-	globalHeaders []header
-	globalAuth    auth
+	srv *Server
+
+	steps             []step
+	vars              map[string]string
+	arrays            map[string][]string
+	globalHeaders     []header
+	globalAuth        auth
+	globalErrorPolicy errorPolicy
+	globalSigning     signing
+	globalCompression string
+
+	// TLS config from the @tls statement, nil if the Servers TLS options should be used.
+	tls *tls.Config
+
+	// Proxy from the @proxy statement, empty if the Servers proxy should be used.
+	proxyURL string
+
+	// DNS overrides from the @resolve statement by host:port.
+	resolve map[string]string
+
+	// Network shape from the @network statement, nil if the Servers network shape should be used,
+	// and the bandwidth of each network shape shared by the jobs of the same virtual user.
+	networkShape    *networkShape
+	workerBandwidth map[networkShape]*bandwidth
+
+	// The WebSocket connection opened by ws connect.
+	ws *webSocket
+
+	// Descriptor set from the @descriptor statement and the gRPC connections of the job, decided by the connection model.
+	grpcFiles *protoregistry.Files
+	grpcConns *grpcConnSet
+
+	// Weighted pool of browser profiles from the @profiles statement and the profile picked for the job.
+	profiles map[string]int
+	profile  string
+
+	// OAuth2 tokens shared by the jobs of the same virtual user and the last digest challenge of the job.
+	workerTokens *tokenCache
+	digest       *digestChallenge
+
+	// Cookies declared by the cookie statement. They are added to the cookie jar before the first request they match,
+	// and again when their value changes. seededCookies holds the values last added.
 	cookies       []http.Cookie
+	seededCookies map[string]string
+	jar           *cookiejar.Jar
+
+	// Loaded JSON Schemas by file name, so that every schema is only loaded once per job.
+	schemas map[string]*jsonSchema
+
+	// Custom step types being expanded while the steps are parsed, so that a keyword can't recurse into itself.
+	customSteps map[string]bool
 
 	// For variables. The addTo contains which step index to add sub steps to. For now we only use one value in the slice
 	// since nested for loops are not supported.
@@ -58,14 +140,64 @@ type step struct {
 
 	forloop forloop
 
-	conditions []condition
+	conditions     []condition
+	expect         []expectation
+	errorPolicy    errorPolicy
+	redirectPolicy redirectPolicy
+	responseMode   responseMode
+	protocol       string
+	signing        signing
+	compression    string
 
-	// Only used for storing results of replaced cookies. All cookies are global.
+	// Only used for storing the cookies that were sent. All cookies are global.
 	cookies []http.Cookie
 	auth    auth
 	url     string
 	body    string
 	varfrom []varfromItem
+
+	// Only used for storing the number of varfrom items that didn't match anything.
+	varfromMisses int
+
+	// Only used for storing the followed redirects and the final URL after them.
+	redirects []ResultRedirect
+	finalURL  string
+
+	// Only used for storing the protocol and TLS connection details of the response.
+	responseProtocol string
+	tlsVersion       string
+	tlsCipher        string
+
+	// Only used for storing the timing breakdown of the request.
+	timing ResultTiming
+
+	// Only used for storing the transfer sizes of the request and the encoding of the response.
+	bytesSent       int64
+	bytesReceived   int64
+	bytesDecoded    int64
+	contentEncoding string
+
+	// Only used for storing if the response body was truncated by the capture response mode.
+	bodyTruncated bool
+
+	// The action of ws steps, and only used for storing the result of them.
+	ws       *webSocketAction
+	wsResult *ResultWebSocket
+
+	// Descriptor set from the descriptor statement, and only used for storing the status of gRPC steps.
+	grpcFiles  *protoregistry.Files
+	grpcStatus string
+
+	// The query, operation name and variables of graphql steps.
+	graphql *graphQL
+
+	// The event to wait for in sse steps, and only used for storing the result of them.
+	sse       *sseMatch
+	sseResult *ResultSSE
+
+	// Hooks added by custom step types.
+	beforeRequest []StepHook
+	afterResponse []StepHook
 }
 
 type forloop struct {
@@ -97,8 +229,17 @@ type array struct {
 }
 
 type auth struct {
+	Type     string `json:"type"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Token    string `json:"token"`
+
+	// OAuth2 client credentials.
+	TokenURL     string `json:"tokenUrl"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+	Scope        string `json:"scope"`
+	Cache        string `json:"cache"`
 }
 
 type header struct {
@@ -110,9 +251,24 @@ type varfromItem struct {
 	From      string `json:"from"`
 	Varname   string `json:"name"`
 	OrgSyntax string `json:"find"`
+	Header    string `json:"header"`
+	Required  bool   `json:"required"`
+	Default   string `json:"default"`
 	Syntax    string `json:"-"`
 }
 
+type expectation struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Value string `json:"value"`
+
+	statuses []statusRange
+	regexp   *regexp.Regexp
+	maxTime  time.Duration
+	schema   *jsonSchema
+}
+
 type condition struct {
 	Type string `json:"type"`
 	Var1 string `json:"var1"`
@@ -121,11 +277,13 @@ type condition struct {
 
 // Result contains the result of a job.
 type Result struct {
-	StartTime time.Time     `json:"startTime"`
-	Status    int           `json:"status"`
-	Duration  time.Duration `json:"duration"`
-	Steps     []*ResultStep `json:"steps"`
-	Err       *ResultError  `json:"error"`
+	StartTime  time.Time      `json:"startTime"`
+	Status     int            `json:"status"`
+	Duration   time.Duration  `json:"duration"`
+	Steps      []*ResultStep  `json:"steps"`
+	Err        *ResultError   `json:"error"`
+	SoftErrors []*ResultError `json:"softErrors"`
+	Profile    string         `json:"profile"`
 }
 
 // ResultStep contains the processed step results.
@@ -138,6 +296,33 @@ type ResultStep struct {
 	Headers   []header      `json:"headers"`
 	Cookies   []http.Cookie `json:"cookies"`
 	Body      string        `json:"body"`
+
+	FinalURL   string           `json:"finalUrl"`
+	Redirects  []ResultRedirect `json:"redirects"`
+	Protocol   string           `json:"protocol"`
+	TLSVersion string           `json:"tlsVersion"`
+	TLSCipher  string           `json:"tlsCipher"`
+
+	BytesSent       int64  `json:"bytesSent"`
+	BytesReceived   int64  `json:"bytesReceived"`
+	BytesDecoded    int64  `json:"bytesDecoded"`
+	ContentEncoding string `json:"contentEncoding"`
+	BodyTruncated   bool   `json:"bodyTruncated"`
+
+	Timing           ResultTiming     `json:"timing"`
+	ExtractionMisses int              `json:"extractionMisses"`
+	WebSocket        *ResultWebSocket `json:"webSocket"`
+	GRPCStatus       string           `json:"grpcStatus"`
+	SSE              *ResultSSE       `json:"sse"`
+}
+
+// ResultRedirect contains a redirect that was followed by a step.
+type ResultRedirect struct {
+	StartTime time.Time     `json:"startTime"`
+	Duration  time.Duration `json:"duration"`
+	Status    int           `json:"status"`
+	URL       string        `json:"url"`
+	Location  string        `json:"location"`
 }
 
 // ResultError contains the error and the step of the error.
@@ -147,4 +332,7 @@ type ResultError struct {
 	Status int         `json:"status"`
 	Body   string      `json:"body"`
 	Step   *ResultStep `json:"step"`
+	Soft   bool        `json:"soft"`
+
+	Expectations []string `json:"expectations"`
 }
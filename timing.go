@@ -0,0 +1,114 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// ResultTiming contains the timing breakdown of a step. When redirects were followed the phases are of the last request,
+// while Total is from the first request being sent until the body of the last response was read.
+// TimeToFirstByte is from the start of the request until the first byte of the response, including DNS lookup,
+// TCP connect and TLS handshake. ContentDownload is from the first byte of the response until the body was read.
+type ResultTiming struct {
+	DNSLookup        time.Duration `json:"dnsLookup"`
+	TCPConnect       time.Duration `json:"tcpConnect"`
+	TLSHandshake     time.Duration `json:"tlsHandshake"`
+	TimeToFirstByte  time.Duration `json:"timeToFirstByte"`
+	ContentDownload  time.Duration `json:"contentDownload"`
+	Total            time.Duration `json:"total"`
+	ConnectionReused bool          `json:"connectionReused"`
+}
+
+// stepTimer records the timing of a request with a httptrace.ClientTrace. The trace callbacks can be
+// called from other goroutines than the one sending the request, so all access is guarded by mu.
+type stepTimer struct {
+	mu sync.Mutex
+
+	start     time.Time
+	hopStart  time.Time
+	dnsStart  time.Time
+	dnsDone   time.Time
+	connStart time.Time
+	connDone  time.Time
+	tlsStart  time.Time
+	tlsDone   time.Time
+	firstByte time.Time
+	reused    bool
+}
+
+// newStepTimer will create a new stepTimer starting now.
+// Returns *stepTimer.
+func newStepTimer() *stepTimer {
+	now := time.Now()
+	return &stepTimer{start: now, hopStart: now}
+}
+
+// trace will return a httptrace.ClientTrace recording the timing of the request on the stepTimer t.
+// Every new connection attempt resets the phases, so that only the last request of any redirects is recorded.
+// Returns *httptrace.ClientTrace.
+func (t *stepTimer) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			if !t.firstByte.IsZero() {
+				t.hopStart = time.Now()
+				t.dnsStart, t.dnsDone = time.Time{}, time.Time{}
+				t.connStart, t.connDone = time.Time{}, time.Time{}
+				t.tlsStart, t.tlsDone = time.Time{}, time.Time{}
+				t.firstByte = time.Time{}
+			}
+		},
+		DNSStart:          func(httptrace.DNSStartInfo) { t.set(&t.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { t.set(&t.dnsDone) },
+		ConnectStart:      func(string, string) { t.set(&t.connStart) },
+		ConnectDone:       func(string, string, error) { t.set(&t.connDone) },
+		TLSHandshakeStart: func() { t.set(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.set(&t.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.reused = info.Reused
+		},
+		GotFirstResponseByte: func() { t.set(&t.firstByte) },
+	}
+}
+
+// set will set the time ts to now.
+func (t *stepTimer) set(ts *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	*ts = time.Now()
+}
+
+// done will return the timing of the request with the body read now.
+// Returns ResultTiming.
+func (t *stepTimer) done() ResultTiming {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return ResultTiming{
+		DNSLookup:        between(t.dnsStart, t.dnsDone),
+		TCPConnect:       between(t.connStart, t.connDone),
+		TLSHandshake:     between(t.tlsStart, t.tlsDone),
+		TimeToFirstByte:  between(t.hopStart, t.firstByte),
+		ContentDownload:  between(t.firstByte, now),
+		Total:            now.Sub(t.start),
+		ConnectionReused: t.reused,
+	}
+}
+
+// between returns the time between start and end, or 0 if any of them wasn't recorded.
+// Returns time.Duration.
+func between(start time.Time, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
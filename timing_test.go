@@ -0,0 +1,67 @@
+package steptest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTiming(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("second"))
+	}))
+	defer ts.Close()
+
+	srv, err := New(1, 5000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := srv.parseJob(&rawJob{steps: "- get " + ts.URL + "\n- get " + ts.URL + "\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	first, second := r.Steps[0].Timing, r.Steps[1].Timing
+	if first.ConnectionReused || first.TCPConnect == 0 {
+		t.Errorf("Expected the first step to open a new connection but got reused %t and connect %s", first.ConnectionReused, first.TCPConnect)
+	}
+
+	if !second.ConnectionReused || second.TCPConnect != 0 {
+		t.Errorf("Expected the second step to reuse the connection but got reused %t and connect %s", second.ConnectionReused, second.TCPConnect)
+	}
+
+	for i, step := range r.Steps {
+		if step.Timing.TimeToFirstByte < 20*time.Millisecond {
+			t.Errorf("Expected time to first byte of step %d to be at least 20ms but got %s", i, step.Timing.TimeToFirstByte)
+		}
+
+		if step.Timing.ContentDownload < 20*time.Millisecond {
+			t.Errorf("Expected content download of step %d to be at least 20ms but got %s", i, step.Timing.ContentDownload)
+		}
+
+		if step.Timing.Total < step.Timing.TimeToFirstByte+step.Timing.ContentDownload || step.Duration < step.Timing.Total {
+			t.Errorf("Expected the total of step %d to cover the whole request and the duration to cover the whole step but got %s and %s", i, step.Timing.Total, step.Duration)
+		}
+	}
+
+	srv.results = []*Result{r}
+	if reused := srv.GetNumberOfReusedConnections(); reused != 1 {
+		t.Errorf("Expected 1 reused connection but got %d", reused)
+	}
+
+	if avg := srv.GetAverageTiming(); avg.TCPConnect != first.TCPConnect || avg.Total != (first.Total+second.Total)/2 {
+		t.Errorf("Expected average connect %s and total %s but got %s and %s", first.TCPConnect, (first.Total+second.Total)/2, avg.TCPConnect, avg.Total)
+	}
+}
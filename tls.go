@@ -0,0 +1,200 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+var (
+	// Allowed TLS versions for the minVersion and maxVersion TLS options.
+	allowedTLSVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+// TLSOptions contains the TLS settings of the built-in client. CertFile and KeyFile are PEM files with the
+// client certificate used for mutual TLS, and CAFile is a PEM bundle of CAs trusted in addition to the system ones.
+// ServerName overrides the server name used for SNI and certificate verification.
+// InsecureSkipVerify is a pointer so that an explicit false can override true. MinVersion and MaxVersion can be
+// 1.0, 1.1, 1.2 or 1.3.
+type TLSOptions struct {
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	CAFile             string `json:"caFile"`
+	InsecureSkipVerify *bool  `json:"insecureSkipVerify"`
+	ServerName         string `json:"serverName"`
+	MinVersion         string `json:"minVersion"`
+	MaxVersion         string `json:"maxVersion"`
+}
+
+// merge will return a copy of TLS options o where all values that are set in TLS options n has been overwritten.
+// Returns TLSOptions.
+func (o TLSOptions) merge(n *TLSOptions) TLSOptions {
+	if n.CertFile != "" || n.KeyFile != "" {
+		o.CertFile, o.KeyFile = n.CertFile, n.KeyFile
+	}
+
+	if n.CAFile != "" {
+		o.CAFile = n.CAFile
+	}
+
+	if n.InsecureSkipVerify != nil {
+		o.InsecureSkipVerify = n.InsecureSkipVerify
+	}
+
+	if n.ServerName != "" {
+		o.ServerName = n.ServerName
+	}
+
+	if n.MinVersion != "" {
+		o.MinVersion = n.MinVersion
+	}
+
+	if n.MaxVersion != "" {
+		o.MaxVersion = n.MaxVersion
+	}
+
+	return o
+}
+
+// tlsConfig will create a *tls.Config from the TLS options o, loading any certificate files.
+// Returns *tls.Config and error.
+func (o *TLSOptions) tlsConfig() (*tls.Config, error) {
+	c := &tls.Config{
+		InsecureSkipVerify: o.InsecureSkipVerify != nil && *o.InsecureSkipVerify,
+		ServerName:         o.ServerName,
+	}
+
+	switch {
+	case o.CertFile != "" && o.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load client certificate. %s", err.Error())
+		}
+		c.Certificates = []tls.Certificate{cert}
+
+	case o.CertFile != "" || o.KeyFile != "":
+		return nil, fmt.Errorf("Both certFile and keyFile must be supplied for a client certificate")
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read CA file. %s", err.Error())
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Couldn't find any certificates in CA file %s", o.CAFile)
+		}
+		c.RootCAs = pool
+	}
+
+	var err error
+	if c.MinVersion, err = parseTLSVersion(o.MinVersion); err != nil {
+		return nil, err
+	}
+
+	if c.MaxVersion, err = parseTLSVersion(o.MaxVersion); err != nil {
+		return nil, err
+	}
+
+	if c.MinVersion != 0 && c.MaxVersion != 0 && c.MinVersion > c.MaxVersion {
+		return nil, fmt.Errorf("minVersion %s is higher than maxVersion %s", o.MinVersion, o.MaxVersion)
+	}
+
+	return c, nil
+}
+
+// parseTLSVersion will parse the TLS version v. An empty version returns 0 which uses the crypto/tls default.
+// Returns uint16 and error.
+func parseTLSVersion(v string) (uint16, error) {
+	if v == "" {
+		return 0, nil
+	}
+
+	version, ok := allowedTLSVersions[v]
+	if !ok {
+		versions := []string{}
+		for name := range allowedTLSVersions {
+			versions = append(versions, name)
+		}
+		sort.Strings(versions)
+
+		return 0, fmt.Errorf("TLS version %s is not supported. Supported versions are %s", v, versions)
+	}
+	return version, nil
+}
+
+// loadTLSConfig will return the *tls.Config for TLS options o. Configs are cached on the Server so that
+// certificate files are only loaded once and jobs with the same options share connections.
+// Returns *tls.Config and error.
+func (srv *Server) loadTLSConfig(o *TLSOptions) (*tls.Config, error) {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.tlsMu.Lock()
+	defer srv.tlsMu.Unlock()
+
+	if c, ok := srv.tlsConfigs[string(b)]; ok {
+		return c, nil
+	}
+
+	c, err := o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if srv.tlsConfigs == nil {
+		srv.tlsConfigs = make(map[string]*tls.Config)
+	}
+	srv.tlsConfigs[string(b)] = c
+
+	return c, nil
+}
+
+// tlsConfig will return the *tls.Config to use for the job j. The jobs TLS options takes precedence over the Servers.
+// Returns *tls.Config.
+func (j *job) tlsConfig() *tls.Config {
+	switch {
+	case j.tls != nil:
+		return j.tls
+
+	case j.srv != nil:
+		return j.srv.tlsConfig
+	}
+
+	return nil
+}
+
+// SetTLSOptions sets the TLS settings o of the built-in client for all jobs. Can be overridden per job
+// by the @tls statement. Certificate files are loaded when SetTLSOptions is called.
+// Returns error.
+func (srv *Server) SetTLSOptions(o TLSOptions) error {
+	if srv.running {
+		return fmt.Errorf("Couldn't set TLS options in *Server.SetTLSOptions. The Server is already running")
+	}
+
+	c, err := srv.loadTLSConfig(&o)
+	if err != nil {
+		return fmt.Errorf("Couldn't set TLS options in *Server.SetTLSOptions. %s", err.Error())
+	}
+
+	srv.tlsOptions = o
+	srv.tlsConfig = c
+	return nil
+}
@@ -0,0 +1,136 @@
+package steptest
+
+import (
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTLSServer will start a HTTP/2 TLS server and write its certificate to a CA file.
+// Returns the server and the path of the CA file.
+func newTLSServer(t *testing.T) (*httptest.Server, string) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	ts.EnableHTTP2 = true
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+
+	return ts, caFile
+}
+
+func TestTLSOptions(t *testing.T) {
+	ts, caFile := newTLSServer(t)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+	if err := srv.SetTLSOptions(TLSOptions{CAFile: caFile, ServerName: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		steps    string
+		version  string
+		protocol string
+	}{
+		{"default", "- get " + ts.URL + "\n", "TLS 1.3", "HTTP/2.0"},
+		{"max version", "- @tls { \"maxVersion\": \"1.2\" }\n- get " + ts.URL + "\n", "TLS 1.2", "HTTP/2.0"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			j, err := srv.parseJob(&rawJob{steps: test.steps})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := srv.fetchJob(j, srv.fetchFunc)
+			if r.Err != nil {
+				t.Fatal(r.Err.Error)
+			}
+
+			step := r.Steps[len(r.Steps)-1]
+			if step.TLSVersion != test.version {
+				t.Errorf("Expected TLS version %s but got %s", test.version, step.TLSVersion)
+			}
+
+			if step.Protocol != test.protocol {
+				t.Errorf("Expected protocol %s but got %s", test.protocol, step.Protocol)
+			}
+
+			if step.TLSCipher == "" {
+				t.Errorf("Expected TLS cipher to be recorded but got empty string")
+			}
+		})
+	}
+}
+
+func TestTLSInsecureSkipVerify(t *testing.T) {
+	ts, _ := newTLSServer(t)
+	defer ts.Close()
+
+	srv, _ := New(1, 5000, nil)
+
+	// The certificate of the test server isn't trusted without the CA.
+	j, err := srv.parseJob(&rawJob{steps: "- get " + ts.URL + "\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err == nil {
+		t.Errorf("Expected certificate error without CA but got nil")
+	}
+
+	// An explicit insecureSkipVerify false in @tls overrides true on the Server.
+	insecure := true
+	if err := srv.SetTLSOptions(TLSOptions{InsecureSkipVerify: &insecure}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		steps string
+		fail  bool
+	}{
+		{"server", "- get " + ts.URL + "\n", false},
+		{"job override", "- @tls { \"insecureSkipVerify\": false }\n- get " + ts.URL + "\n", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			j, err := srv.parseJob(&rawJob{steps: test.steps})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if r := srv.fetchJob(j, srv.fetchFunc); (r.Err != nil) != test.fail {
+				t.Errorf("Expected failure to be %t but got %v", test.fail, r.Err)
+			}
+		})
+	}
+}
+
+func TestTLSOptionsInvalid(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+
+	if err := srv.SetTLSOptions(TLSOptions{MinVersion: "1.4"}); err == nil {
+		t.Errorf("Expected error for unsupported TLS version but got nil")
+	}
+
+	if err := srv.SetTLSOptions(TLSOptions{CertFile: "client.pem"}); err == nil {
+		t.Errorf("Expected error for certFile without keyFile but got nil")
+	}
+
+	if _, err := srv.parseJob(&rawJob{steps: "- @tls { \"caFile\": \"missing.pem\" }\n"}); err == nil {
+		t.Errorf("Expected error for missing CA file but got nil")
+	}
+}
@@ -0,0 +1,230 @@
+package steptest
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestConnectionModel(t *testing.T) {
+	var conns int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	ts.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, test := range []struct {
+		model string
+		conns int32
+	}{
+		{"shared", 1},
+		{"worker", 1},
+		{"job", 3},
+	} {
+		t.Run(test.model, func(t *testing.T) {
+			atomic.StoreInt32(&conns, 0)
+
+			srv, err := New(1, 5000, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := srv.SetConnectionModel(test.model); err != nil {
+				t.Fatal(err)
+			}
+
+			c, done := srv.fetchFuncForWorker()
+			defer done()
+
+			for i := 0; i < 3; i++ {
+				j, err := srv.parseJob(&rawJob{steps: "- get " + ts.URL + "\n"})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if r := srv.fetchJob(j, c); r.Err != nil {
+					t.Fatal(r.Err.Error)
+				}
+			}
+
+			if got := atomic.LoadInt32(&conns); got != test.conns {
+				t.Errorf("Expected %d connections but got %d", test.conns, got)
+			}
+		})
+	}
+}
+
+func TestSetConnectionModelInvalid(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+	if err := srv.SetConnectionModel("browser"); err == nil {
+		t.Errorf("Expected error for unsupported connection model but got nil")
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	ts.Config.Protocols = new(http.Protocols)
+	ts.Config.Protocols.SetHTTP1(true)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	defer ts.Close()
+
+	srv, err := New(1, 5000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := srv.parseJob(&rawJob{steps: "- get " + ts.URL + "\n- get " + ts.URL + "\n  protocol h2c\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	for i, expected := range []string{"HTTP/1.1", "HTTP/2.0"} {
+		if r.Steps[i].Protocol != expected {
+			t.Errorf("Expected protocol %s for step %d but got %s", expected, i, r.Steps[i].Protocol)
+		}
+	}
+
+	if err := srv.SetProtocol("h3"); err == nil {
+		t.Errorf("Expected error for unsupported protocol but got nil")
+	}
+
+	if _, err := srv.parseJob(&rawJob{steps: "- get " + ts.URL + "\n  protocol spdy\n"}); err == nil {
+		t.Errorf("Expected error for unsupported protocol statement but got nil")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	ts := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("direct"))
+	})
+
+	proxy := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		w.Write([]byte("proxied"))
+	})
+
+	srv, err := New(1, 5000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.SetProxy(strings.Replace(proxy.URL, "http://", "http://user:secret@", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := srv.parseJob(&rawJob{steps: "- get http://backend.invalid/path\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	if proxied := proxy.requests(); len(proxied) != 1 || proxied[0].URL.String() != "http://backend.invalid/path" {
+		t.Errorf("Expected the request to http://backend.invalid/path to go through the proxy but got %d proxied requests", len(proxied))
+	}
+
+	// The @proxy statement takes precedence over the Servers proxy.
+	j, err = srv.parseJob(&rawJob{steps: "- @proxy none\n- get " + ts.URL + "\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	if proxied, direct := proxy.requests(), ts.requests(); len(proxied) != 1 || len(direct) != 1 {
+		t.Errorf("Expected @proxy none to bypass the proxy but got %d proxied and %d direct requests", len(proxied), len(direct))
+	}
+
+	for _, p := range []string{"ftp://proxy:21", "http://", "socks4://proxy:1080"} {
+		if err := srv.SetProxy(p); err == nil {
+			t.Errorf("Expected error for invalid proxy %s but got nil", p)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	var hosts, serverNames []string
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		if r.TLS != nil {
+			serverNames = append(serverNames, r.TLS.ServerName)
+		}
+	}))
+	ts.StartTLS()
+	defer ts.Close()
+
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, _ := New(1, 5000, nil)
+	if err := srv.SetTLSOptions(TLSOptions{CAFile: caFile}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.SetResolve(map[string]string{"example.com:" + port: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate of the test server is valid for example.com, so the request only
+	// succeeds if the SNI and the certificate verification uses the original host.
+	steps := "- @resolve shop.example.com:" + port + "=127.0.0.1:" + port + "\n"
+	steps += "- get https://example.com:" + port + "/\n"
+
+	j, err := srv.parseJob(&rawJob{steps: steps})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	if len(hosts) != 1 || hosts[0] != "example.com:"+port || serverNames[0] != "example.com" {
+		t.Errorf("Expected Host example.com:%s and SNI example.com but got %v and %v", port, hosts, serverNames)
+	}
+
+	// A job without the override for shop.example.com can't reach it.
+	j, _ = srv.parseJob(&rawJob{steps: "- get https://shop.example.com:" + port + "/\n"})
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err == nil {
+		t.Errorf("Expected error for shop.example.com without @resolve but got nil")
+	}
+
+	for _, a := range []string{"example.com=127.0.0.1", "example.com:443=localhost", "example.com:443"} {
+		if _, err := srv.parseJob(&rawJob{steps: "- @resolve " + a + "\n"}); err == nil {
+			t.Errorf("Expected error for invalid @resolve %s but got nil", a)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+// Package steptest makes transactional load test easy.
+package steptest
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsMaxMessageSize    = 16 * 1024 * 1024 // wsMaxMessageSize is the max size of a received message.
+	wsDefaultTimeout    = 10000            // wsDefaultTimeout is the timeout in milliseconds of ws expect if no timeout was supplied.
+	wsCloseTimeout      = time.Second      // wsCloseTimeout is how long ws close waits for the server to answer the close frame.
+	wsHandshakeDeadline = 30 * time.Second // wsHandshakeDeadline is the max time of a handshake or send if the Server has no timeout.
+)
+
+var (
+	// Allowed actions for the ws statement.
+	allowedWebSocketActions = []string{"connect", "send", "expect", "close"}
+)
+
+// webSocketAction contains the action of a ws step. Connect uses the URL of the step, send sends the body of the
+// step and expect waits until a message matches pattern, or fails after timeout milliseconds.
+type webSocketAction struct {
+	Action  string `json:"-"`
+	Pattern string `json:"pattern"`
+	Timeout int    `json:"timeout"`
+}
+
+// ResultWebSocket contains the result of a ws step. RoundTrip is the time from the last message sent until the
+// message matching ws expect was received, and MessagesReceived is the number of messages received while waiting for it.
+type ResultWebSocket struct {
+	Action           string        `json:"action"`
+	Message          string        `json:"message"`
+	RoundTrip        time.Duration `json:"roundTrip"`
+	MessagesReceived int           `json:"messagesReceived"`
+}
+
+// webSocket is an open WebSocket connection of a job.
+type webSocket struct {
+	conn     *websocket.Conn
+	url      string
+	res      *http.Response
+	lastSend time.Time
+}
+
+// createWebSocket will create a ws step based on step s and args a, which is the action followed by
+// the URL for connect, the message for send and a JSON object with pattern and timeout for expect.
+// Returns error.
+func createWebSocket(j *job, s *step, a *string) error {
+	v := strings.SplitN(strings.Trim(*a, trim), separator, 2)
+	ws := &webSocketAction{Action: strings.ToLower(v[0])}
+
+	args := ""
+	if len(v) > 1 {
+		args = strings.Trim(v[1], trim)
+	}
+
+	switch ws.Action {
+	case "connect":
+		if args == "" {
+			return fmt.Errorf("ws connect was declared but URL was not supplied in createWebSocket. Raw %s", *a)
+		}
+
+		if !strings.HasPrefix(args, "ws://") && !strings.HasPrefix(args, "wss://") {
+			return fmt.Errorf("ws connect was declared but the URL isn't ws:// or wss:// in createWebSocket. Raw %s", *a)
+		}
+		s.url = args
+
+	case "send":
+		if args == "" {
+			return fmt.Errorf("ws send was declared but MESSAGE was not supplied in createWebSocket. Raw %s", *a)
+		}
+		s.body = args
+
+	case "expect":
+		err := json.Unmarshal([]byte(args), ws)
+		if err != nil {
+			return fmt.Errorf("ws expect was declared but we couldn't unmarshal it in createWebSocket. Raw %s", *a)
+		}
+
+		if ws.Pattern == "" {
+			return fmt.Errorf("ws expect was declared but PATTERN was not supplied in createWebSocket. Raw %s", *a)
+		}
+
+		if !strings.Contains(ws.Pattern, "{{") {
+			if _, err := regexp.Compile(ws.Pattern); err != nil {
+				return fmt.Errorf("ws expect was declared but PATTERN is invalid in createWebSocket. %s. Raw %s", err.Error(), *a)
+			}
+		}
+
+		if ws.Timeout == 0 {
+			ws.Timeout = wsDefaultTimeout
+		}
+
+	case "close":
+
+	default:
+		return fmt.Errorf("ws was declared with unsupported action %s in createWebSocket. Supported actions are %s. Raw %s", ws.Action, allowedWebSocketActions, *a)
+	}
+
+	s.method = "WS"
+	s.ws = ws
+	return nil
+}
+
+// webSocketStep will run the ws step s. Connect opens the jobs WebSocket connection, which is used by the following
+// ws steps until it's closed by ws close or the job ends. Which handshake status codes and transport errors that
+// results in an error is decided by the error policy of the step, job and Server. The timing of the step is stored in s.timing.
+// Returns the status code of the handshake and *ResultError.
+func (j *job) webSocketStep(c func(*http.Request) (*http.Response, error), s *step) (int, *ResultError) {
+	if !j.checkConditions(s) {
+		return 0, nil
+	}
+
+	j.replaceFromVariables(s)
+	policy := j.errorPolicy(s)
+	start := time.Now()
+	s.wsResult = &ResultWebSocket{Action: s.ws.Action}
+	defer func() {
+		s.timing.Total = time.Now().Sub(start)
+	}()
+
+	if s.ws.Action == "connect" {
+		return j.webSocketConnect(c, s, policy)
+	}
+
+	ws := j.ws
+	if ws == nil {
+		return -1, &ResultError{Error: fmt.Errorf("ws %s was declared but there is no open WebSocket connection in *job.webSocketStep", s.ws.Action), Status: -1}
+	}
+	s.url = ws.url
+
+	switch s.ws.Action {
+	case "send":
+		ws.conn.SetWriteDeadline(start.Add(j.webSocketTimeout()))
+		err := ws.conn.WriteMessage(websocket.TextMessage, []byte(s.body))
+		ws.conn.SetWriteDeadline(time.Time{})
+		if err != nil {
+			return -1, j.webSocketError(s, policy, fmt.Errorf("Couldn't send message in *job.webSocketStep. %w", err))
+		}
+		ws.lastSend = time.Now()
+		s.wsResult.Message = s.body
+		s.bytesSent = int64(len(s.body))
+
+	case "expect":
+		return j.webSocketExpect(s, ws, start, policy)
+
+	case "close":
+		j.closeWebSocket()
+	}
+
+	return http.StatusSwitchingProtocols, nil
+}
+
+// webSocketConnect will open a WebSocket connection to the URL of step s with the headers, cookies, auth and proxy
+// of the job. Any connection that is already open is closed first. Which handshake status codes and transport errors
+// that results in an error is decided by the error policy p.
+// Returns the status code of the handshake and *ResultError.
+func (j *job) webSocketConnect(c func(*http.Request) (*http.Response, error), s *step, p errorPolicy) (int, *ResultError) {
+	j.closeWebSocket()
+
+	req, err := http.NewRequest("GET", "http"+strings.TrimPrefix(s.url, "ws"), nil)
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("Error creating up the Request in *job.webSocketConnect. %s", err), URL: s.url, Status: -1}
+	}
+
+	err = j.addAuth(c, s, req)
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("Couldn't add auth to the Request in *job.webSocketConnect. %s", err.Error()), URL: s.url, Status: -1}
+	}
+	j.addOptions(s, req)
+
+	proxy, err := j.webSocketProxy()
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("Couldn't use the proxy in *job.webSocketConnect. %s", err.Error()), URL: s.url, Status: -1}
+	}
+
+	cfg := &tls.Config{}
+	if tlsConfig := j.tlsConfig(); tlsConfig != nil {
+		cfg = tlsConfig.Clone()
+	}
+	cfg.NextProtos = []string{"http/1.1"}
+
+	dialer := &websocket.Dialer{
+		NetDialContext:   j.dialContext(),
+		Proxy:            proxy,
+		TLSClientConfig:  cfg,
+		HandshakeTimeout: j.webSocketTimeout(),
+	}
+
+	timer := newStepTimer()
+	ctx := httptrace.WithClientTrace(context.Background(), timer.trace())
+	conn, res, err := dialer.DialContext(ctx, s.url, req.Header)
+	s.timing = timer.done()
+
+	switch {
+	case res != nil && res.StatusCode != http.StatusSwitchingProtocols:
+		s.responseProtocol = res.Proto
+		j.storeResponseCookies(res)
+		if !s.expectsStatus() && p.isErrorStatus(res.StatusCode) {
+			body, _ := ioutil.ReadAll(res.Body)
+			return res.StatusCode, &ResultError{Error: fmt.Errorf("%d %s %s", res.StatusCode, s.method, s.url), URL: s.url, Status: res.StatusCode, Body: string(body)}
+		}
+		return res.StatusCode, j.checkExpectations(s, res, &[]byte{}, s.timing.TimeToFirstByte)
+
+	case err != nil:
+		return -1, j.webSocketError(s, p, fmt.Errorf("Error in WebSocket handshake in *job.webSocketConnect. %w", err))
+	}
+
+	if tlsConn, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+		s.tlsVersion = tls.VersionName(tlsConn.ConnectionState().Version)
+		s.tlsCipher = tls.CipherSuiteName(tlsConn.ConnectionState().CipherSuite)
+	}
+	s.responseProtocol = res.Proto
+	j.storeResponseCookies(res)
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	j.ws = &webSocket{conn: conn, url: s.url, res: res, lastSend: time.Now()}
+
+	resErr := j.checkExpectations(s, res, &[]byte{}, s.timing.TimeToFirstByte)
+	if resErr != nil {
+		return res.StatusCode, resErr
+	}
+
+	return res.StatusCode, j.variablesFrom(s, res, &[]byte{}, s.timing.TimeToFirstByte)
+}
+
+// webSocketTimeout will return the max time of a handshake or of sending a message, which is the timeout of the Server.
+// Returns time.Duration.
+func (j *job) webSocketTimeout() time.Duration {
+	if j.srv != nil && j.srv.timeout > 0 {
+		return j.srv.timeout
+	}
+	return wsHandshakeDeadline
+}
+
+// webSocketProxy will return the proxy function for WebSocket connections of the job j. Without a proxy the proxy
+// is taken from the environment, and the proxy none disables proxies. https proxies aren't supported.
+// Returns func(*http.Request) (*url.URL, error) and error.
+func (j *job) webSocketProxy() (func(*http.Request) (*url.URL, error), error) {
+	switch p := j.proxy(); p {
+	case "":
+		return http.ProxyFromEnvironment, nil
+
+	case "none":
+		return nil, nil
+
+	default:
+		// The proxy was validated by parseProxy when it was set.
+		u, _ := url.Parse(p)
+		switch u.Scheme {
+		case "https":
+			return nil, fmt.Errorf("Proxy scheme %s is not supported for WebSocket connections", u.Scheme)
+
+		case "socks5h":
+			// Host names are always resolved by the proxy.
+			u.Scheme = "socks5"
+		}
+		return http.ProxyURL(u), nil
+	}
+}
+
+// webSocketExpect will read messages from the WebSocket connection ws until one matches the pattern of step s, or fail
+// if none did within the timeout. The matched message is used as the body by any varfrom and expect statements of step s.
+// Pings are answered while reading. Which transport errors that results in an error is decided by the error policy p.
+// Returns the status code of the handshake and *ResultError.
+func (j *job) webSocketExpect(s *step, ws *webSocket, start time.Time, p errorPolicy) (int, *ResultError) {
+	pattern, err := regexp.Compile(j.replaceVariables(s.ws.Pattern))
+	if err != nil {
+		return -1, &ResultError{Error: fmt.Errorf("Couldn't compile regular expression in *job.webSocketExpect. %s", err.Error()), URL: s.url, Status: -1}
+	}
+
+	ws.conn.SetReadDeadline(start.Add(time.Duration(s.ws.Timeout) * time.Millisecond))
+	defer ws.conn.SetReadDeadline(time.Time{})
+
+	for {
+		_, msg, err := ws.conn.ReadMessage()
+		if err != nil {
+			// A failed read can't be continued, so the connection is closed.
+			j.ws = nil
+			ws.conn.Close()
+
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				err = fmt.Errorf("No message matched %s within %d ms. %w", s.ws.Pattern, s.ws.Timeout, err)
+			}
+			return -1, j.webSocketError(s, p, fmt.Errorf("ws expect failed in *job.webSocketExpect. %w", err))
+		}
+
+		s.wsResult.MessagesReceived++
+		s.bytesReceived += int64(len(msg))
+		if !pattern.Match(msg) {
+			continue
+		}
+
+		rtt := time.Now().Sub(ws.lastSend)
+		s.wsResult.Message = string(msg)
+		s.wsResult.RoundTrip = rtt
+
+		resErr := j.checkExpectations(s, ws.res, &msg, rtt)
+		if resErr != nil {
+			return ws.res.StatusCode, resErr
+		}
+
+		return ws.res.StatusCode, j.variablesFrom(s, ws.res, &msg, rtt)
+	}
+}
+
+// webSocketError will return a *ResultError with the transport error err for the ws step s, or nil if
+// the error policy p doesn't count it as a failure.
+// Returns *ResultError.
+func (*job) webSocketError(s *step, p errorPolicy, err error) *ResultError {
+	if !p.isTransportError(err) {
+		return nil
+	}
+	return &ResultError{Error: err, URL: s.url, Status: -1}
+}
+
+// closeWebSocket will close the jobs j WebSocket connection if it's open. A close frame is sent
+// and the close frame answering it is awaited for at most wsCloseTimeout. The answer isn't answered
+// again, since the connection has already sent its close frame.
+func (j *job) closeWebSocket() {
+	ws := j.ws
+	if ws == nil {
+		return
+	}
+	j.ws = nil
+
+	deadline := time.Now().Add(wsCloseTimeout)
+	err := ws.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+	if err == nil {
+		ws.conn.SetReadDeadline(deadline)
+		for {
+			if _, _, err := ws.conn.ReadMessage(); err != nil {
+				break
+			}
+		}
+	}
+	ws.conn.Close()
+}
@@ -0,0 +1,222 @@
+package steptest
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// stockHandler returns a WebSocket handler that answers {"subscribe":"sku"} with an ack and the stock of the sku.
+// The close code received from the client, or -1 if the client sent more frames after the close handshake, is sent on closed.
+func stockHandler(t *testing.T, closed chan int) http.HandlerFunc {
+	upgrader := websocket.Upgrader{}
+	sku := regexp.MustCompile(`"subscribe":"([^"]+)"`)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/forbidden" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(time.Second))
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				code := 0
+				if e, ok := err.(*websocket.CloseError); ok {
+					code = e.Code
+				}
+
+				// Nothing but the end of the connection should follow the close handshake.
+				conn.UnderlyingConn().SetReadDeadline(time.Now().Add(time.Second))
+				if n, _ := conn.UnderlyingConn().Read(make([]byte, 16)); n > 0 {
+					code = -1
+				}
+				closed <- code
+				return
+			}
+
+			if m := sku.FindSubmatch(msg); m != nil {
+				conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"ack"}`))
+				conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"stock","sku":"`+string(m[1])+`","qty":5}`))
+			}
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	closed := make(chan int, 1)
+	ts := newTestServer(t, stockHandler(t, closed))
+
+	srv, _ := New(1, 5000, nil)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	steps := "- cookie { \"name\": \"session\", \"value\": \"abc\" }\n"
+	steps += "- var { \"name\": \"sku\", \"value\": \"sku-1\" }\n"
+	steps += "- ws connect " + url + "/stock\n"
+	steps += "  header { \"name\": \"X-Client\", \"value\": \"steptest\" }\n"
+	steps += "- ws send {\"subscribe\":\"{{sku}}\"}\n"
+	steps += "- ws expect { \"pattern\": \"\\\"sku\\\":\\\"{{sku}}\\\"\", \"timeout\": 2000 }\n"
+	steps += "  varfrom { \"from\": \"body\", \"name\": \"qty\", \"find\": \"\\\"qty\\\":{{StepTestSyntax}}}\" }\n"
+	steps += "- ws close\n"
+
+	j, err := srv.parseJob(&rawJob{steps: steps})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := srv.fetchJob(j, srv.fetchFunc)
+	if r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+
+	handshake := ts.requests()[0]
+	if c, err := handshake.Cookie("session"); err != nil || c.Value != "abc" || handshake.Header.Get("X-Client") != "steptest" {
+		t.Errorf("Expected the handshake to send the cookie abc and header steptest but got %s and %s", handshake.Header.Get("Cookie"), handshake.Header.Get("X-Client"))
+	}
+
+	if j.vars["qty"] != "5" {
+		t.Errorf("Expected qty 5 from the received message but got %s", j.vars["qty"])
+	}
+
+	connect, expect := r.Steps[2], r.Steps[4]
+	if connect.Status != http.StatusSwitchingProtocols || connect.Timing.Total == 0 || connect.Timing.TimeToFirstByte == 0 {
+		t.Errorf("Expected status 101 and the handshake timing but got %d and %+v", connect.Status, connect.Timing)
+	}
+
+	// The ack message doesn't match the pattern but is counted.
+	if expect.WebSocket.MessagesReceived != 2 || expect.WebSocket.RoundTrip == 0 || expect.URL != url+"/stock" {
+		t.Errorf("Expected 2 messages received with a round trip time but got %d and %s", expect.WebSocket.MessagesReceived, expect.WebSocket.RoundTrip)
+	}
+
+	// ws close sends a single close frame and doesn't answer the close frame of the server.
+	if code := <-closed; code != websocket.CloseNormalClosure {
+		t.Errorf("Expected a single close frame with code %d but got %d", websocket.CloseNormalClosure, code)
+	}
+}
+
+func TestWebSocketErrors(t *testing.T) {
+	closed := make(chan int, 1)
+	ts := newTestServer(t, stockHandler(t, closed))
+
+	srv, _ := New(1, 5000, nil)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	for _, test := range []struct {
+		name   string
+		steps  string
+		err    string
+		soft   bool
+		closed bool
+	}{
+		{"timeout", "- ws connect " + url + "\n- ws expect { \"pattern\": \"never\", \"timeout\": 50 }\n", "within 50 ms", false, true},
+		{"soft timeout", "- ws connect " + url + "\n- ws expect { \"pattern\": \"never\", \"timeout\": 50 }\n  errors { \"soft\": true }\n", "within 50 ms", true, true},
+		{"ignored timeout", "- ws connect " + url + "\n- ws expect { \"pattern\": \"never\", \"timeout\": 50 }\n  errors { \"transport\": [ \"refused\" ] }\n", "", false, true},
+		{"handshake status", "- ws connect " + url + "/forbidden\n", "403 WS", false, false},
+		{"expected handshake status", "- ws connect " + url + "/forbidden\n  expect { \"type\": \"status\", \"value\": \"403\" }\n", "", false, false},
+		{"no connection", "- ws send hello\n", "no open WebSocket connection", false, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			j, err := srv.parseJob(&rawJob{steps: test.steps})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := srv.fetchJob(j, srv.fetchFunc)
+			if test.closed {
+				<-closed
+			}
+
+			errs := r.SoftErrors
+			if r.Err != nil {
+				errs = append(errs, r.Err)
+			}
+
+			switch {
+			case test.err == "" && len(errs) > 0:
+				t.Errorf("Expected no error but got %s", errs[0].Error)
+
+			case test.err != "" && (len(errs) != 1 || !strings.Contains(errs[0].Error.Error(), test.err)):
+				t.Errorf("Expected an error containing %q but got %v", test.err, errs)
+
+			case test.err != "" && errs[0].Soft != test.soft:
+				t.Errorf("Expected soft to be %t but got %t", test.soft, errs[0].Soft)
+			}
+		})
+	}
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	closed := make(chan int, 1)
+	ts := newTestServer(t, stockHandler(t, closed))
+
+	// proxy tunnels CONNECT requests to the address requested.
+	proxy := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		backend, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer backend.Close()
+
+		w.WriteHeader(http.StatusOK)
+		conn, brw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+
+		go func() {
+			io.Copy(backend, brw)
+			backend.Close()
+		}()
+		io.Copy(conn, backend)
+	})
+
+	srv, _ := New(1, 5000, nil)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	j, err := srv.parseJob(&rawJob{steps: "- @proxy " + proxy.URL + "\n- ws connect " + url + "\n- ws close\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err != nil {
+		t.Fatal(r.Err.Error)
+	}
+	<-closed
+
+	if tunneled := proxy.requests(); len(tunneled) != 1 || tunneled[0].Host != strings.TrimPrefix(ts.URL, "http://") {
+		t.Errorf("Expected the connection to be tunneled through the proxy but got %d tunneled connections", len(tunneled))
+	}
+
+	j, _ = srv.parseJob(&rawJob{steps: "- @proxy https://proxy.invalid:3128\n- ws connect " + url + "\n"})
+	if r := srv.fetchJob(j, srv.fetchFunc); r.Err == nil || !strings.Contains(r.Err.Error.Error(), "not supported") {
+		t.Errorf("Expected error for a https proxy but got %v", r.Err)
+	}
+}
+
+func TestCreateWebSocket(t *testing.T) {
+	srv, _ := New(1, 5000, nil)
+
+	for _, a := range []string{"connect http://example.com", "send", "expect { \"timeout\": 10 }", "listen"} {
+		if _, err := srv.parseJob(&rawJob{steps: "- ws " + a + "\n"}); err == nil {
+			t.Errorf("Expected error for invalid ws %s but got nil", a)
+		}
+	}
+}